@@ -0,0 +1,52 @@
+package authorization
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+type allowlist struct {
+	path string
+}
+
+func newAllowlist(path string) *allowlist {
+	return &allowlist{path: path}
+}
+
+// AuthorizePublish looks up the stream key in the allowlist file. Each line holds
+// a stream key, optionally followed by the canonical stream key to publish under
+// and/or the word `private`. Empty lines and lines starting with `#` are ignored.
+// The file is read on every request so it can be edited while running.
+func (a *allowlist) AuthorizePublish(req PublishRequest) (Grant, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return Grant{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || fields[0] != req.StreamKey {
+			continue
+		}
+
+		grant := Grant{StreamKey: req.StreamKey}
+		for _, field := range fields[1:] {
+			if field == "private" {
+				grant.Private = true
+			} else {
+				grant.StreamKey = field
+			}
+		}
+
+		return grant, nil
+	}
+
+	if err = scanner.Err(); err != nil {
+		return Grant{}, err
+	}
+
+	return Grant{}, ErrUnauthorized
+}
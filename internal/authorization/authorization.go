@@ -0,0 +1,123 @@
+package authorization
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+type (
+	// PublishRequest describes a broadcaster that wants to publish, or to
+	// act on its broadcast as Action tells
+	PublishRequest struct {
+		Action        string         `json:"action"`
+		StreamKey     string         `json:"streamKey"`
+		RemoteAddress string         `json:"remoteAddress"`
+		UserAgent     string         `json:"userAgent"`
+		Media         []OfferedMedia `json:"media"`
+	}
+
+	// OfferedMedia summarizes a media section of the WHIP offer
+	OfferedMedia struct {
+		Kind   string   `json:"kind"`
+		Codecs []string `json:"codecs"`
+		RIDs   []string `json:"rids,omitempty"`
+	}
+
+	// Grant describes how an authorized broadcast is published
+	Grant struct {
+		// StreamKey the broadcast is published under, it may differ from the one requested
+		StreamKey string
+		// Private streams can only be watched with a playback token
+		Private bool
+	}
+
+	// Authorizer decides if a broadcast may start
+	Authorizer interface {
+		AuthorizePublish(PublishRequest) (Grant, error)
+	}
+
+	allowAll struct{}
+)
+
+const (
+	// ActionPublish starts a broadcast
+	ActionPublish = "publish"
+	// ActionMetadata inserts timed metadata into a live broadcast, it has no media
+	ActionMetadata = "metadata"
+)
+
+// ErrUnauthorized is returned when a publish request is rejected
+var ErrUnauthorized = errors.New("stream key is not authorized to publish")
+
+var authorizer Authorizer = allowAll{}
+
+// Configure picks the Authorizer. PUBLISH_AUTH_WEBHOOK_URL takes precedence
+// over PUBLISH_AUTH_ALLOWLIST_FILE, when neither is set every stream key is accepted.
+func Configure() {
+	switch {
+	case os.Getenv("PUBLISH_AUTH_WEBHOOK_URL") != "":
+		log.Println("Authorizing publishers with webhook `" + os.Getenv("PUBLISH_AUTH_WEBHOOK_URL") + "`")
+		authorizer = newWebhook(os.Getenv("PUBLISH_AUTH_WEBHOOK_URL"))
+	case os.Getenv("PUBLISH_AUTH_ALLOWLIST_FILE") != "":
+		log.Println("Authorizing publishers with allowlist `" + os.Getenv("PUBLISH_AUTH_ALLOWLIST_FILE") + "`")
+		authorizer = newAllowlist(os.Getenv("PUBLISH_AUTH_ALLOWLIST_FILE"))
+	default:
+		authorizer = allowAll{}
+	}
+}
+
+// AuthorizePublish asks the configured Authorizer if req may publish
+func AuthorizePublish(req PublishRequest) (Grant, error) {
+	return authorizer.AuthorizePublish(req)
+}
+
+// NewPublishRequest builds a PublishRequest and summarizes the media of the offer
+func NewPublishRequest(streamKey, remoteAddress, userAgent, offer string) PublishRequest {
+	req := PublishRequest{
+		Action:        ActionPublish,
+		StreamKey:     streamKey,
+		RemoteAddress: remoteAddress,
+		UserAgent:     userAgent,
+		Media:         []OfferedMedia{},
+	}
+
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			kind, _, _ := strings.Cut(strings.TrimPrefix(line, "m="), " ")
+			req.Media = append(req.Media, OfferedMedia{Kind: kind, Codecs: []string{}})
+		case len(req.Media) == 0:
+			continue
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			if _, rtpmap, ok := strings.Cut(line, " "); ok {
+				codec, _, _ := strings.Cut(rtpmap, "/")
+				req.Media[len(req.Media)-1].Codecs = append(req.Media[len(req.Media)-1].Codecs, codec)
+			}
+		case strings.HasPrefix(line, "a=rid:"):
+			rid, _, _ := strings.Cut(strings.TrimPrefix(line, "a=rid:"), " ")
+			req.Media[len(req.Media)-1].RIDs = append(req.Media[len(req.Media)-1].RIDs, rid)
+		}
+	}
+
+	return req
+}
+
+// NewMetadataRequest builds the PublishRequest of a broadcaster that wants to
+// insert timed metadata
+func NewMetadataRequest(streamKey, remoteAddress, userAgent string) PublishRequest {
+	return PublishRequest{
+		Action:        ActionMetadata,
+		StreamKey:     streamKey,
+		RemoteAddress: remoteAddress,
+		UserAgent:     userAgent,
+		Media:         []OfferedMedia{},
+	}
+}
+
+func (allowAll) AuthorizePublish(req PublishRequest) (Grant, error) {
+	return Grant{StreamKey: req.StreamKey}, nil
+}
@@ -0,0 +1,69 @@
+package authorization
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const webhookTimeout = 5 * time.Second
+
+type (
+	webhook struct {
+		url    string
+		client *http.Client
+	}
+
+	webhookResponse struct {
+		StreamKey string `json:"streamKey"`
+		Private   bool   `json:"private"`
+	}
+)
+
+func newWebhook(url string) *webhook {
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// AuthorizePublish POSTs the request as JSON to the webhook. Any 2xx allows the
+// broadcast, the response may carry a canonical `streamKey` to publish under and
+// mark the stream `private`.
+func (w *webhook) AuthorizePublish(req PublishRequest) (Grant, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Grant{}, err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Grant{}, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Grant{}, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Grant{}, fmt.Errorf("%w: webhook responded %d", ErrUnauthorized, resp.StatusCode)
+	}
+
+	r := webhookResponse{}
+	if len(bytes.TrimSpace(respBody)) != 0 {
+		if err = json.Unmarshal(respBody, &r); err != nil {
+			return Grant{}, err
+		}
+	}
+
+	if r.StreamKey == "" {
+		r.StreamKey = req.StreamKey
+	}
+
+	return Grant{StreamKey: r.StreamKey, Private: r.Private}, nil
+}
@@ -0,0 +1,239 @@
+package fmp4
+
+import "errors"
+
+const av1OBUSequenceHeader = 1
+
+var errAV1NotSequenceHeader = errors.New("OBU is not a AV1 sequence header")
+
+type av1SequenceHeader struct {
+	seqProfile, seqLevelIdx0, seqTier0  uint32
+	highBitdepth, twelveBit, monochrome bool
+	subsamplingX, subsamplingY          uint32
+	chromaSamplePosition                uint32
+	maxFrameWidth, maxFrameHeight       uint32
+}
+
+// AV1OBUPayload splits an OBU with obu_has_size_field set into its type and payload
+func AV1OBUPayload(obu []byte) (obuType byte, payload []byte, err error) {
+	if len(obu) < 1 {
+		return 0, nil, errBitstreamTooShort
+	}
+
+	obuType = obu[0] >> 3 & 0x0F
+	headerSize := 1
+	if obu[0]&0x04 != 0 {
+		headerSize++
+	}
+
+	if len(obu) < headerSize {
+		return 0, nil, errBitstreamTooShort
+	} else if obu[0]&0x02 == 0 {
+		return obuType, obu[headerSize:], nil
+	}
+
+	size, sizeLength := uint64(0), 0
+	for i := 0; i < 8; i++ {
+		if headerSize+i >= len(obu) {
+			return 0, nil, errBitstreamTooShort
+		}
+
+		size |= uint64(obu[headerSize+i]&0x7F) << (7 * i)
+		if obu[headerSize+i]&0x80 == 0 {
+			sizeLength = i + 1
+			break
+		}
+	}
+
+	start := headerSize + sizeLength
+	if sizeLength == 0 || uint64(len(obu)-start) < size {
+		return 0, nil, errBitstreamTooShort
+	}
+
+	return obuType, obu[start : start+int(size)], nil
+}
+
+// parseAV1SequenceHeader reads the fields of a sequence header OBU payload
+// the av1C and the track header need
+func parseAV1SequenceHeader(payload []byte) (*av1SequenceHeader, error) {
+	h := &av1SequenceHeader{}
+	r := &bitReader{data: payload}
+
+	h.seqProfile = r.bits(3)
+	r.bit() // still_picture
+	reducedStillPictureHeader := r.flag()
+
+	if reducedStillPictureHeader {
+		h.seqLevelIdx0 = r.bits(5)
+	} else {
+		decoderModelInfoPresent := false
+		bufferDelayLength := 0
+
+		if r.flag() { // timing_info_present_flag
+			r.bits(32) // num_units_in_display_tick
+			r.bits(32) // time_scale
+			if r.flag() {
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+
+			if decoderModelInfoPresent = r.flag(); decoderModelInfoPresent {
+				bufferDelayLength = int(r.bits(5)) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(5)  // buffer_removal_time_length_minus_1
+				r.bits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+
+		initialDisplayDelayPresent := r.flag()
+		operatingPoints := int(r.bits(5)) + 1
+		for i := 0; i < operatingPoints && r.err == nil; i++ {
+			r.bits(12) // operating_point_idc
+			seqLevelIdx := r.bits(5)
+			seqTier := uint32(0)
+			if seqLevelIdx > 7 {
+				seqTier = r.bit()
+			}
+
+			if i == 0 {
+				h.seqLevelIdx0, h.seqTier0 = seqLevelIdx, seqTier
+			}
+
+			if decoderModelInfoPresent && r.flag() {
+				r.bits(bufferDelayLength) // decoder_buffer_delay
+				r.bits(bufferDelayLength) // encoder_buffer_delay
+				r.bit()                   // low_delay_mode_flag
+			}
+
+			if initialDisplayDelayPresent && r.flag() {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+
+	frameWidthBits := int(r.bits(4)) + 1
+	frameHeightBits := int(r.bits(4)) + 1
+	h.maxFrameWidth = r.bits(frameWidthBits) + 1
+	h.maxFrameHeight = r.bits(frameHeightBits) + 1
+
+	if !reducedStillPictureHeader && r.flag() { // frame_id_numbers_present_flag
+		r.bits(4) // delta_frame_id_length_minus_2
+		r.bits(3) // additional_frame_id_length_minus_1
+	}
+
+	r.bit() // use_128x128_superblock
+	r.bit() // enable_filter_intra
+	r.bit() // enable_intra_edge
+
+	if !reducedStillPictureHeader {
+		r.bit() // enable_interintra_compound
+		r.bit() // enable_masked_compound
+		r.bit() // enable_warped_motion
+		r.bit() // enable_dual_filter
+
+		enableOrderHint := r.flag()
+		if enableOrderHint {
+			r.bit() // enable_jnt_comp
+			r.bit() // enable_ref_frame_mvs
+		}
+
+		seqForceScreenContentTools := uint32(2)
+		if !r.flag() { // seq_choose_screen_content_tools
+			seqForceScreenContentTools = r.bit()
+		}
+
+		if seqForceScreenContentTools > 0 && !r.flag() { // seq_choose_integer_mv
+			r.bit() // seq_force_integer_mv
+		}
+
+		if enableOrderHint {
+			r.bits(3) // order_hint_bits_minus_1
+		}
+	}
+
+	r.bit() // enable_superres
+	r.bit() // enable_cdef
+	r.bit() // enable_restoration
+
+	// color_config
+	h.highBitdepth = r.flag()
+	if h.seqProfile == 2 && h.highBitdepth {
+		h.twelveBit = r.flag()
+	}
+
+	if h.seqProfile != 1 {
+		h.monochrome = r.flag()
+	}
+
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint32(2), uint32(2), uint32(2)
+	if r.flag() { // color_description_present_flag
+		colorPrimaries, transferCharacteristics, matrixCoefficients = r.bits(8), r.bits(8), r.bits(8)
+	}
+
+	switch {
+	case h.monochrome:
+		r.bit() // color_range
+		h.subsamplingX, h.subsamplingY = 1, 1
+	case colorPrimaries == 1 && transferCharacteristics == 13 && matrixCoefficients == 0:
+		// sRGB is always 4:4:4
+	default:
+		r.bit() // color_range
+		switch {
+		case h.seqProfile == 0:
+			h.subsamplingX, h.subsamplingY = 1, 1
+		case h.seqProfile == 2 && h.twelveBit:
+			if h.subsamplingX = r.bit(); h.subsamplingX == 1 {
+				h.subsamplingY = r.bit()
+			}
+		case h.seqProfile == 2:
+			h.subsamplingX = 1
+		}
+
+		if h.subsamplingX == 1 && h.subsamplingY == 1 {
+			h.chromaSamplePosition = r.bits(2)
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return h, nil
+}
+
+// NewAV1Track returns a video track for AV1 in the low overhead bitstream
+// format, configured by the sequence header OBU of the stream
+func NewAV1Track(id uint32, sequenceHeader []byte) (*Track, error) {
+	obuType, payload, err := AV1OBUPayload(sequenceHeader)
+	if err != nil {
+		return nil, err
+	} else if obuType != av1OBUSequenceHeader {
+		return nil, errAV1NotSequenceHeader
+	}
+
+	h, err := parseAV1SequenceHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := byte(h.seqTier0<<7) | byte(h.subsamplingX<<3) | byte(h.subsamplingY<<2) | byte(h.chromaSamplePosition)
+	if h.highBitdepth {
+		flags |= 0x40
+	}
+	if h.twelveBit {
+		flags |= 0x20
+	}
+	if h.monochrome {
+		flags |= 0x10
+	}
+
+	av1C := append([]byte{0x81, byte(h.seqProfile<<5) | byte(h.seqLevelIdx0), flags, 0}, sequenceHeader...)
+
+	return &Track{
+		ID:         id,
+		TimeScale:  VideoTimeScale,
+		sampleType: "av01",
+		config:     box("av1C", av1C),
+		width:      uint16(h.maxFrameWidth),
+		height:     uint16(h.maxFrameHeight),
+	}, nil
+}
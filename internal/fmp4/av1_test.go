@@ -0,0 +1,133 @@
+package fmp4
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// bitWriter is the counterpart of bitReader
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) bits(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.pos%8)
+		w.pos++
+	}
+}
+
+// testAV1SequenceHeader is the sequence header OBU of 8 bit 4:2:0 1280x720
+// main profile at level 4.0
+func testAV1SequenceHeader() []byte {
+	w := &bitWriter{}
+	w.bits(3, 0)     // seq_profile
+	w.bits(1, 0)     // still_picture
+	w.bits(1, 0)     // reduced_still_picture_header
+	w.bits(1, 0)     // timing_info_present_flag
+	w.bits(1, 0)     // initial_display_delay_present_flag
+	w.bits(5, 0)     // operating_points_cnt_minus_1
+	w.bits(12, 0)    // operating_point_idc
+	w.bits(5, 8)     // seq_level_idx
+	w.bits(1, 0)     // seq_tier
+	w.bits(4, 10)    // frame_width_bits_minus_1
+	w.bits(4, 10)    // frame_height_bits_minus_1
+	w.bits(11, 1279) // max_frame_width_minus_1
+	w.bits(11, 719)  // max_frame_height_minus_1
+	w.bits(1, 0)     // frame_id_numbers_present_flag
+	w.bits(3, 0b011) // use_128x128_superblock, enable_filter_intra, enable_intra_edge
+	w.bits(4, 0)     // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+	w.bits(3, 0b100) // enable_order_hint, enable_jnt_comp, enable_ref_frame_mvs
+	w.bits(1, 1)     // seq_choose_screen_content_tools
+	w.bits(1, 1)     // seq_choose_integer_mv
+	w.bits(3, 6)     // order_hint_bits_minus_1
+	w.bits(3, 0b011) // enable_superres, enable_cdef, enable_restoration
+	w.bits(1, 0)     // high_bitdepth
+	w.bits(1, 0)     // mono_chrome
+	w.bits(1, 0)     // color_description_present_flag
+	w.bits(1, 0)     // color_range
+	w.bits(2, 0)     // chroma_sample_position
+	w.bits(1, 0)     // separate_uv_delta_q
+	w.bits(1, 0)     // film_grain_params_present
+	w.bits(1, 1)     // trailing_one_bit
+
+	return append([]byte{av1OBUSequenceHeader<<3 | 0x02, byte(len(w.data))}, w.data...)
+}
+
+func TestAV1Track(t *testing.T) {
+	sequenceHeader := testAV1SequenceHeader()
+
+	track, err := NewAV1Track(1, sequenceHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if width, height := track.Size(); width != 1280 || height != 720 {
+		t.Fatalf("expected 1280x720, got %dx%d", width, height)
+	}
+
+	av01 := parseSegment(t, InitSegment(track)).path(t, "moov", "trak", "mdia", "minf", "stbl", "stsd", "av01")
+
+	// marker and version, seq_profile and seq_level_idx_0, seq_tier_0 and
+	// the color config, no initial_presentation_delay, then the configOBUs
+	expected := append([]byte{0x81, 0x08, 0x0C, 0}, sequenceHeader...)
+	if av1C := av01.path(t, "av1C"); !bytes.Equal(av1C.payload, expected) {
+		t.Fatalf("expected av1C % x, got % x", expected, av1C.payload)
+	}
+}
+
+func TestAV1TrackInvalid(t *testing.T) {
+	sequenceHeader := testAV1SequenceHeader()
+
+	for _, test := range []struct {
+		name string
+		obu  []byte
+		err  error
+	}{
+		{name: "empty", obu: []byte{}, err: errBitstreamTooShort},
+		{name: "temporal delimiter", obu: []byte{2<<3 | 0x02, 0}, err: errAV1NotSequenceHeader},
+		{name: "size beyond the end", obu: sequenceHeader[:len(sequenceHeader)-1], err: errBitstreamTooShort},
+		{name: "truncated payload", obu: append([]byte{sequenceHeader[0], 3}, sequenceHeader[2:5]...), err: errBitstreamTooShort},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewAV1Track(1, test.obu); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestAV1OBUPayload(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		obu     []byte
+		obuType byte
+		payload []byte
+		err     error
+	}{
+		{name: "with size", obu: []byte{0x0A, 2, 0xAA, 0xBB, 0xCC}, obuType: 1, payload: []byte{0xAA, 0xBB}},
+		{name: "without size", obu: []byte{0x08, 0xAA, 0xBB}, obuType: 1, payload: []byte{0xAA, 0xBB}},
+		{name: "with extension", obu: []byte{0x36, 0x10, 1, 0xAA}, obuType: 6, payload: []byte{0xAA}},
+		{name: "two byte size", obu: append([]byte{0x0A, 0x80, 0x01}, make([]byte, 128)...), obuType: 1, payload: make([]byte, 128)},
+		{name: "empty", obu: []byte{}, err: errBitstreamTooShort},
+		{name: "truncated extension", obu: []byte{0x0C}, err: errBitstreamTooShort},
+		{name: "truncated size", obu: []byte{0x0A, 0x80}, err: errBitstreamTooShort},
+		{name: "payload shorter than size", obu: []byte{0x0A, 3, 0xAA}, err: errBitstreamTooShort},
+		{name: "size of more than 8 bytes", obu: []byte{0x0A, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0}, err: errBitstreamTooShort},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			obuType, payload, err := AV1OBUPayload(test.obu)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			} else if err == nil && (obuType != test.obuType || !bytes.Equal(payload, test.payload)) {
+				t.Fatalf("expected type %d with % x, got type %d with % x", test.obuType, test.payload, obuType, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package fmp4
+
+import "errors"
+
+var errBitstreamTooShort = errors.New("bitstream is too short")
+
+// bitReader reads the big endian bit fields of codec headers
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint32 {
+	return r.bits(1)
+}
+
+func (r *bitReader) bits(n int) (v uint32) {
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errBitstreamTooShort
+			return 0
+		}
+
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+
+	return
+}
+
+func (r *bitReader) flag() bool {
+	return r.bit() == 1
+}
+
+// ue reads an Exp-Golomb coded unsigned integer
+func (r *bitReader) ue() uint32 {
+	leadingZeros := 0
+	for !r.flag() {
+		if r.err != nil || leadingZeros == 32 {
+			r.err = errBitstreamTooShort
+			return 0
+		}
+		leadingZeros++
+	}
+
+	return 1<<leadingZeros - 1 + r.bits(leadingZeros)
+}
+
+// se reads an Exp-Golomb coded signed integer
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int32(v / 2)
+	}
+
+	return int32(v/2) + 1
+}
+
+// uvlc reads the variable length unsigned integer of AV1
+func (r *bitReader) uvlc() uint32 {
+	leadingZeros := 0
+	for !r.flag() {
+		if r.err != nil {
+			return 0
+		}
+		leadingZeros++
+	}
+
+	if leadingZeros >= 32 {
+		return 1<<32 - 1
+	}
+
+	return r.bits(leadingZeros) + 1<<leadingZeros - 1
+}
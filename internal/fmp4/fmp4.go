@@ -0,0 +1,240 @@
+// Package fmp4 writes fragmented MP4 (ISO/IEC 14496-12) with H264, AV1 and
+// Opus tracks. An init segment describes the tracks, every fragment carries
+// the samples of some time span of them.
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// VideoTimeScale is the RTP clock rate of video
+	VideoTimeScale = 90000
+
+	// OpusTimeScale is the clock rate Opus is always sent with
+	OpusTimeScale = 48000
+
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// unityMatrix is the transformation matrix of movie and track headers
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+type (
+	// Track is a track of the init segment
+	Track struct {
+		ID        uint32
+		TimeScale uint32
+
+		sampleType    string
+		config        []byte
+		width, height uint16
+		channels      uint16
+	}
+
+	// Sample is a frame of video or a packet of audio
+	Sample struct {
+		Duration uint32
+		Keyframe bool
+		Data     []byte
+	}
+
+	// TrackFragment are the samples of a track in a fragment, BaseDecodeTime is
+	// the decode time of the first one since the start of the track
+	TrackFragment struct {
+		Track          *Track
+		BaseDecodeTime uint64
+		Samples        []Sample
+	}
+)
+
+// NewOpusTrack returns an audio track for Opus
+func NewOpusTrack(id uint32, channels uint16) *Track {
+	dOps := []byte{0, byte(channels)}
+	dOps = binary.BigEndian.AppendUint16(dOps, 0) // PreSkip
+	dOps = binary.BigEndian.AppendUint32(dOps, OpusTimeScale)
+	dOps = binary.BigEndian.AppendUint16(dOps, 0) // OutputGain
+	dOps = append(dOps, 0)                        // ChannelMappingFamily
+
+	return &Track{
+		ID:         id,
+		TimeScale:  OpusTimeScale,
+		sampleType: "Opus",
+		config:     box("dOps", dOps),
+		channels:   channels,
+	}
+}
+
+// Size returns the width and height of a video track
+func (t *Track) Size() (width, height uint16) {
+	return t.width, t.height
+}
+
+// IsVideo reports if the track is a video track
+func (t *Track) IsVideo() bool {
+	return t.sampleType != "Opus"
+}
+
+func box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, boxType...)
+	for _, payload := range payloads {
+		b = append(b, payload...)
+	}
+
+	return b
+}
+
+func fullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+func uint32s(values ...uint32) (b []byte) {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+
+	return
+}
+
+// InitSegment returns the ftyp and moov boxes that describe tracks
+func InitSegment(tracks ...*Track) []byte {
+	ftyp := box("ftyp", []byte("iso6"), uint32s(0), []byte("iso6mp41"))
+
+	nextTrackID := uint32(1)
+	traks := [][]byte{}
+	trexs := [][]byte{}
+	for _, t := range tracks {
+		if t.ID >= nextTrackID {
+			nextTrackID = t.ID + 1
+		}
+
+		traks = append(traks, t.trak())
+		trexs = append(trexs, fullBox("trex", 0, 0, uint32s(t.ID, 1, 0, 0, 0)))
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		uint32s(0, 0, 1000, 0), // creation_time, modification_time, timescale, duration
+		uint32s(0x00010000),    // rate
+		[]byte{1, 0, 0, 0},     // volume, reserved
+		make([]byte, 8),
+		uint32s(unityMatrix...),
+		make([]byte, 24),
+		uint32s(nextTrackID),
+	)
+
+	moov := box("moov", append(append([][]byte{mvhd}, traks...), box("mvex", trexs...))...)
+	return append(ftyp, moov...)
+}
+
+func (t *Track) trak() []byte {
+	volume, handlerType, handlerName := []byte{1, 0}, "soun", "SoundHandler"
+	mediaHeader := fullBox("smhd", 0, 0, make([]byte, 4))
+	if t.IsVideo() {
+		volume, handlerType, handlerName = []byte{0, 0}, "vide", "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+
+	tkhd := fullBox("tkhd", 0, 3,
+		uint32s(0, 0, t.ID, 0, 0), // creation_time, modification_time, track_ID, reserved, duration
+		make([]byte, 8),
+		[]byte{0, 0, 0, 0}, // layer, alternate_group
+		volume,
+		[]byte{0, 0},
+		uint32s(unityMatrix...),
+		uint32s(uint32(t.width)<<16, uint32(t.height)<<16),
+	)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		uint32s(0, 0, t.TimeScale, 0), // creation_time, modification_time, timescale, duration
+		[]byte{0x55, 0xC4, 0, 0},      // language `und`, pre_defined
+	)
+
+	hdlr := fullBox("hdlr", 0, 0, uint32s(0), []byte(handlerType), make([]byte, 12), []byte(handlerName+"\x00"))
+
+	dinf := box("dinf", fullBox("dref", 0, 0, uint32s(1), fullBox("url ", 0, 1)))
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, uint32s(1), t.sampleEntry()),
+		fullBox("stts", 0, 0, uint32s(0)),
+		fullBox("stsc", 0, 0, uint32s(0)),
+		fullBox("stsz", 0, 0, uint32s(0, 0)),
+		fullBox("stco", 0, 0, uint32s(0)),
+	)
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
+
+func (t *Track) sampleEntry() []byte {
+	header := []byte{0, 0, 0, 0, 0, 0, 0, 1} // reserved, data_reference_index
+	if !t.IsVideo() {
+		return box(t.sampleType, header,
+			make([]byte, 8),
+			[]byte{byte(t.channels >> 8), byte(t.channels), 0, 16}, // channelcount, samplesize
+			make([]byte, 4),
+			uint32s(OpusTimeScale<<16),
+			t.config,
+		)
+	}
+
+	return box(t.sampleType, header,
+		make([]byte, 16),
+		[]byte{byte(t.width >> 8), byte(t.width), byte(t.height >> 8), byte(t.height)},
+		uint32s(0x00480000, 0x00480000, 0), // horizresolution, vertresolution, reserved
+		[]byte{0, 1},                       // frame_count
+		make([]byte, 32),                   // compressorname
+		[]byte{0, 0x18, 0xFF, 0xFF},        // depth, pre_defined
+		t.config,
+	)
+}
+
+// Fragment returns a moof and mdat box with the samples of fragments
+func Fragment(sequenceNumber uint32, fragments ...TrackFragment) []byte {
+	trafs := [][]byte{}
+	dataOffsetPositions := []int{}
+	mdat := [][]byte{}
+
+	// The moof header and mfhd come before the first traf
+	position := 8 + 16
+	for _, f := range fragments {
+		trun := uint32s(uint32(len(f.Samples)), 0)
+		for _, s := range f.Samples {
+			flags := uint32(sampleFlagsSync)
+			if f.Track.IsVideo() && !s.Keyframe {
+				flags = sampleFlagsNonSync
+			}
+
+			trun = append(trun, uint32s(s.Duration, uint32(len(s.Data)), flags)...)
+			mdat = append(mdat, s.Data)
+		}
+
+		tfhd := fullBox("tfhd", 0, 0x020000, uint32s(f.Track.ID))
+		tfdt := fullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, f.BaseDecodeTime))
+		traf := box("traf", tfhd, tfdt, fullBox("trun", 0, 0x000701, trun))
+
+		// data_offset follows the traf, tfhd, tfdt and trun headers and sample_count
+		dataOffsetPositions = append(dataOffsetPositions, position+8+len(tfhd)+len(tfdt)+12+4)
+		position += len(traf)
+		trafs = append(trafs, traf)
+	}
+
+	moof := box("moof", append([][]byte{fullBox("mfhd", 0, 0, uint32s(sequenceNumber))}, trafs...)...)
+
+	dataOffset := len(moof) + 8
+	for i, f := range fragments {
+		binary.BigEndian.PutUint32(moof[dataOffsetPositions[i]:], uint32(dataOffset))
+		for _, s := range f.Samples {
+			dataOffset += len(s.Data)
+		}
+	}
+
+	return append(moof, box("mdat", mdat...)...)
+}
@@ -0,0 +1,246 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// childrenOffsets are the bytes before the child boxes of boxes that aren't
+// plain containers
+var childrenOffsets = map[string]int{"stsd": 8, "dref": 8, "avc1": 78, "av01": 78, "Opus": 28}
+
+// containers are the boxes parseBox descends into
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "dinf": true, "stbl": true, "mvex": true,
+	"moof": true, "traf": true, "stsd": true, "dref": true, "avc1": true, "av01": true, "Opus": true,
+}
+
+// testBox is a parsed box, the payload of containers is split into children
+type testBox struct {
+	boxType  string
+	payload  []byte
+	children []*testBox
+}
+
+// parseBoxes fails unless data is a sequence of boxes whose sizes add up exactly
+func parseBoxes(t *testing.T, data []byte) []*testBox {
+	t.Helper()
+
+	boxes := []*testBox{}
+	for len(data) != 0 {
+		if len(data) < 8 {
+			t.Fatalf("box header is truncated: % x", data)
+		}
+
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %q has size %d with %d bytes left", data[4:8], size, len(data))
+		}
+
+		b := &testBox{boxType: string(data[4:8]), payload: data[8:size]}
+		if containers[b.boxType] {
+			offset := childrenOffsets[b.boxType]
+			if offset > len(b.payload) {
+				t.Fatalf("box %q is too short for its children", b.boxType)
+			}
+			b.children = parseBoxes(t, b.payload[offset:])
+		}
+
+		boxes = append(boxes, b)
+		data = data[size:]
+	}
+
+	return boxes
+}
+
+// find returns the boxes of boxType among the children of b
+func (b *testBox) find(boxType string) []*testBox {
+	found := []*testBox{}
+	for _, child := range b.children {
+		if child.boxType == boxType {
+			found = append(found, child)
+		}
+	}
+
+	return found
+}
+
+// path returns the only box at the path of box types below b
+func (b *testBox) path(t *testing.T, boxTypes ...string) *testBox {
+	t.Helper()
+
+	for _, boxType := range boxTypes {
+		found := b.find(boxType)
+		if len(found) != 1 {
+			t.Fatalf("expected one %q in %q, found %d", boxType, b.boxType, len(found))
+		}
+		b = found[0]
+	}
+
+	return b
+}
+
+func (b *testBox) uint32At(offset int) uint32 {
+	return binary.BigEndian.Uint32(b.payload[offset:])
+}
+
+// parseSegment parses the top level boxes of a segment
+func parseSegment(t *testing.T, data []byte) *testBox {
+	t.Helper()
+	return &testBox{boxType: "segment", children: parseBoxes(t, data)}
+}
+
+func TestOpusInitSegment(t *testing.T) {
+	segment := parseSegment(t, InitSegment(NewOpusTrack(1, 2)))
+
+	if ftyp := segment.path(t, "ftyp"); !bytes.Equal(ftyp.payload, []byte("iso6\x00\x00\x00\x00iso6mp41")) {
+		t.Fatalf("unexpected ftyp % x", ftyp.payload)
+	}
+
+	moov := segment.path(t, "moov")
+	if nextTrackID := moov.path(t, "mvhd").uint32At(96); nextTrackID != 2 {
+		t.Fatalf("expected next_track_ID 2, got %d", nextTrackID)
+	}
+
+	trak := moov.path(t, "trak")
+	if trackID := trak.path(t, "tkhd").uint32At(12); trackID != 1 {
+		t.Fatalf("expected track_ID 1, got %d", trackID)
+	}
+	if timeScale := trak.path(t, "mdia", "mdhd").uint32At(12); timeScale != OpusTimeScale {
+		t.Fatalf("expected timescale %d, got %d", OpusTimeScale, timeScale)
+	}
+	if handlerType := string(trak.path(t, "mdia", "hdlr").payload[8:12]); handlerType != "soun" {
+		t.Fatalf("expected handler soun, got %s", handlerType)
+	}
+	trak.path(t, "mdia", "minf", "smhd")
+
+	opus := trak.path(t, "mdia", "minf", "stbl", "stsd", "Opus")
+	if channels, sampleRate := binary.BigEndian.Uint16(opus.payload[16:]), opus.uint32At(24)>>16; channels != 2 || sampleRate != OpusTimeScale {
+		t.Fatalf("expected 2 channels at %d, got %d at %d", OpusTimeScale, channels, sampleRate)
+	}
+
+	// Version, OutputChannelCount, PreSkip, InputSampleRate, OutputGain, ChannelMappingFamily
+	expected := []byte{0, 2, 0, 0, 0, 0, 0xBB, 0x80, 0, 0, 0}
+	if dOps := opus.path(t, "dOps"); !bytes.Equal(dOps.payload, expected) {
+		t.Fatalf("expected dOps % x, got % x", expected, dOps.payload)
+	}
+
+	if trackID := moov.path(t, "mvex", "trex").uint32At(4); trackID != 1 {
+		t.Fatalf("expected trex of track 1, got %d", trackID)
+	}
+}
+
+func TestInitSegmentWithTracks(t *testing.T) {
+	video, err := NewH264Track(1, testH264SPS, testH264PPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moov := parseSegment(t, InitSegment(video, NewOpusTrack(2, 2))).path(t, "moov")
+
+	traks := moov.find("trak")
+	if len(traks) != 2 {
+		t.Fatalf("expected 2 traks, got %d", len(traks))
+	}
+
+	for i, handlerType := range []string{"vide", "soun"} {
+		if trackID := traks[i].path(t, "tkhd").uint32At(12); trackID != uint32(i+1) {
+			t.Fatalf("expected track_ID %d, got %d", i+1, trackID)
+		} else if actual := string(traks[i].path(t, "mdia", "hdlr").payload[8:12]); actual != handlerType {
+			t.Fatalf("expected handler %s, got %s", handlerType, actual)
+		}
+	}
+
+	if nextTrackID := moov.path(t, "mvhd").uint32At(96); nextTrackID != 3 {
+		t.Fatalf("expected next_track_ID 3, got %d", nextTrackID)
+	}
+	if trexs := moov.path(t, "mvex").find("trex"); len(trexs) != 2 {
+		t.Fatalf("expected 2 trex, got %d", len(trexs))
+	}
+}
+
+func TestFragment(t *testing.T) {
+	video, err := NewH264Track(1, testH264SPS, testH264PPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio := NewOpusTrack(2, 2)
+
+	fragments := []TrackFragment{
+		{
+			Track:          video,
+			BaseDecodeTime: 0x1_0000_0000,
+			Samples: []Sample{
+				{Duration: 3000, Keyframe: true, Data: []byte{0, 0, 0, 2, 0x65, 1}},
+				{Duration: 3000, Data: []byte{0, 0, 0, 1, 0x41}},
+			},
+		},
+		{
+			Track:          audio,
+			BaseDecodeTime: 960,
+			Samples:        []Sample{{Duration: 960, Data: []byte{0xFC, 1, 2}}},
+		},
+	}
+
+	data := Fragment(7, fragments...)
+	segment := parseSegment(t, data)
+
+	moof := segment.path(t, "moof")
+	if sequenceNumber := moof.path(t, "mfhd").uint32At(4); sequenceNumber != 7 {
+		t.Fatalf("expected sequence_number 7, got %d", sequenceNumber)
+	}
+
+	trafs := moof.find("traf")
+	if len(trafs) != len(fragments) {
+		t.Fatalf("expected %d traf, got %d", len(fragments), len(trafs))
+	}
+
+	moofSize := len(data) - 8 - len(segment.path(t, "mdat").payload)
+	for i, f := range fragments {
+		tfhd := trafs[i].path(t, "tfhd")
+		if flags := tfhd.uint32At(0) & 0xFFFFFF; flags != 0x020000 {
+			t.Fatalf("expected tfhd flags default-base-is-moof, got %#x", flags)
+		} else if trackID := tfhd.uint32At(4); trackID != f.Track.ID {
+			t.Fatalf("expected track_ID %d, got %d", f.Track.ID, trackID)
+		}
+
+		tfdt := trafs[i].path(t, "tfdt")
+		if version, decodeTime := tfdt.payload[0], binary.BigEndian.Uint64(tfdt.payload[4:]); version != 1 || decodeTime != f.BaseDecodeTime {
+			t.Fatalf("expected version 1 tfdt of %d, got version %d of %d", f.BaseDecodeTime, version, decodeTime)
+		}
+
+		trun := trafs[i].path(t, "trun")
+		if flags := trun.uint32At(0) & 0xFFFFFF; flags != 0x000701 {
+			t.Fatalf("expected trun flags 0x701, got %#x", flags)
+		} else if sampleCount := trun.uint32At(4); sampleCount != uint32(len(f.Samples)) {
+			t.Fatalf("expected %d samples, got %d", len(f.Samples), sampleCount)
+		} else if len(trun.payload) != 12+12*len(f.Samples) {
+			t.Fatalf("trun of %d bytes doesn't hold %d samples", len(trun.payload), len(f.Samples))
+		}
+
+		// data_offset is relative to the start of the moof and points at the
+		// samples in the mdat
+		offset := int(trun.uint32At(8))
+		if offset < moofSize+8 {
+			t.Fatalf("data_offset %d points into the moof", offset)
+		}
+
+		for j, s := range f.Samples {
+			entry := 12 + 12*j
+			duration, size, flags := trun.uint32At(entry), trun.uint32At(entry+4), trun.uint32At(entry+8)
+
+			expectedFlags := uint32(sampleFlagsSync)
+			if f.Track.IsVideo() && !s.Keyframe {
+				expectedFlags = sampleFlagsNonSync
+			}
+
+			if duration != s.Duration || size != uint32(len(s.Data)) || flags != expectedFlags {
+				t.Fatalf("traf %d sample %d: expected %d/%d/%#x, got %d/%d/%#x", i, j, s.Duration, len(s.Data), expectedFlags, duration, size, flags)
+			} else if !bytes.Equal(data[offset:offset+int(size)], s.Data) {
+				t.Fatalf("traf %d sample %d: data_offset doesn't point at its data", i, j)
+			}
+			offset += int(size)
+		}
+	}
+}
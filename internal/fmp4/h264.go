@@ -0,0 +1,172 @@
+package fmp4
+
+import "errors"
+
+var errH264ParameterSetsMissing = errors.New("H264 config needs a SPS and a PPS")
+
+// h264HighProfiles carry chroma format and bit depth in their SPS and avcC
+var h264HighProfiles = map[byte]bool{100: true, 110: true, 122: true, 244: true, 44: true, 83: true, 86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true}
+
+type h264SPS struct {
+	profileIDC, constraintFlags, levelIDC byte
+	chromaFormatIDC                       uint32
+	bitDepthLumaMinus8                    uint32
+	bitDepthChromaMinus8                  uint32
+	width, height                         uint32
+}
+
+// h264RBSP removes the emulation prevention bytes of a NAL unit
+func h264RBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+
+	return rbsp
+}
+
+// parseH264SPS reads the fields of a SPS NAL unit the avcC and the track
+// header need
+func parseH264SPS(nalu []byte) (*h264SPS, error) {
+	if len(nalu) < 4 {
+		return nil, errBitstreamTooShort
+	}
+
+	sps := &h264SPS{profileIDC: nalu[1], constraintFlags: nalu[2], levelIDC: nalu[3], chromaFormatIDC: 1}
+	r := &bitReader{data: h264RBSP(nalu[4:])}
+	r.ue() // seq_parameter_set_id
+
+	separateColourPlane := false
+	if h264HighProfiles[sps.profileIDC] {
+		if sps.chromaFormatIDC = r.ue(); sps.chromaFormatIDC == 3 {
+			separateColourPlane = r.flag()
+		}
+		sps.bitDepthLumaMinus8 = r.ue()
+		sps.bitDepthChromaMinus8 = r.ue()
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+
+		if r.flag() { // seq_scaling_matrix_present_flag
+			scalingLists := 8
+			if sps.chromaFormatIDC == 3 {
+				scalingLists = 12
+			}
+
+			for i := 0; i < scalingLists; i++ {
+				if !r.flag() {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+
+				lastScale, nextScale := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if nextScale != 0 {
+						nextScale = (lastScale + r.se() + 256) % 256
+					}
+					if nextScale != 0 {
+						lastScale = nextScale
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && r.err == nil; i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	subWidthC, subHeightC := uint32(1), uint32(1)
+	if !separateColourPlane {
+		switch sps.chromaFormatIDC {
+		case 1:
+			subWidthC, subHeightC = 2, 2
+		case 2:
+			subWidthC = 2
+		}
+	}
+
+	sps.width = widthInMbs*16 - (cropLeft+cropRight)*subWidthC
+	sps.height = (2-frameMbsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*subHeightC*(2-frameMbsOnly)
+	return sps, nil
+}
+
+// NewH264Track returns a video track for H264 in the length prefixed format,
+// configured by the SPS and PPS NAL units of the stream
+func NewH264Track(id uint32, sps, pps []byte) (*Track, error) {
+	if len(sps) == 0 || len(pps) == 0 {
+		return nil, errH264ParameterSetsMissing
+	}
+
+	parsed, err := parseH264SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+
+	avcC := []byte{1, parsed.profileIDC, parsed.constraintFlags, parsed.levelIDC, 0xFF, 0xE1}
+	avcC = append(avcC, byte(len(sps)>>8), byte(len(sps)))
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1, byte(len(pps)>>8), byte(len(pps)))
+	avcC = append(avcC, pps...)
+
+	if h264HighProfiles[parsed.profileIDC] {
+		avcC = append(avcC,
+			0xFC|byte(parsed.chromaFormatIDC),
+			0xF8|byte(parsed.bitDepthLumaMinus8),
+			0xF8|byte(parsed.bitDepthChromaMinus8),
+			0,
+		)
+	}
+
+	return &Track{
+		ID:         id,
+		TimeScale:  VideoTimeScale,
+		sampleType: "avc1",
+		config:     box("avcC", avcC),
+		width:      uint16(parsed.width),
+		height:     uint16(parsed.height),
+	}, nil
+}
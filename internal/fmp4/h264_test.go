@@ -0,0 +1,64 @@
+package fmp4
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var (
+	// Constrained Baseline 640x480
+	testH264SPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x02, 0x80, 0xF6, 0x40}
+	testH264PPS = []byte{0x68, 0xCE, 0x38, 0x80}
+)
+
+func TestH264Track(t *testing.T) {
+	track, err := NewH264Track(1, testH264SPS, testH264PPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if width, height := track.Size(); width != 640 || height != 480 {
+		t.Fatalf("expected 640x480, got %dx%d", width, height)
+	} else if !track.IsVideo() || track.TimeScale != VideoTimeScale {
+		t.Fatalf("expected a video track at %d, got %d", VideoTimeScale, track.TimeScale)
+	}
+
+	trak := parseSegment(t, InitSegment(track)).path(t, "moov", "trak")
+	if width, height := trak.path(t, "tkhd").uint32At(76), trak.path(t, "tkhd").uint32At(80); width != 640<<16 || height != 480<<16 {
+		t.Fatalf("expected tkhd of 640x480, got %dx%d", width>>16, height>>16)
+	}
+	trak.path(t, "mdia", "minf", "vmhd")
+
+	avc1 := trak.path(t, "mdia", "minf", "stbl", "stsd", "avc1")
+	if width, height := avc1.payload[24:26], avc1.payload[26:28]; !bytes.Equal(width, []byte{0x02, 0x80}) || !bytes.Equal(height, []byte{0x01, 0xE0}) {
+		t.Fatalf("expected avc1 of 640x480, got % x by % x", width, height)
+	}
+
+	expected := []byte{1, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0, 9}
+	expected = append(expected, testH264SPS...)
+	expected = append(expected, 1, 0, 4)
+	expected = append(expected, testH264PPS...)
+	if avcC := avc1.path(t, "avcC"); !bytes.Equal(avcC.payload, expected) {
+		t.Fatalf("expected avcC % x, got % x", expected, avcC.payload)
+	}
+}
+
+func TestH264TrackInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		sps, pps []byte
+		err      error
+	}{
+		{name: "no SPS", pps: testH264PPS, err: errH264ParameterSetsMissing},
+		{name: "no PPS", sps: testH264SPS, err: errH264ParameterSetsMissing},
+		{name: "truncated SPS", sps: testH264SPS[:5], pps: testH264PPS, err: errBitstreamTooShort},
+		{name: "SPS header only", sps: testH264SPS[:1], pps: testH264PPS, err: errBitstreamTooShort},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewH264Track(1, test.sps, test.pps); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
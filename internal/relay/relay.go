@@ -1,96 +1,266 @@
+// Package relay restreams local broadcasts to remote WHIP endpoints, like
+// another Broadcast Box or a streaming service that accepts WHIP.
 package relay
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"sync"
+	"time"
 
-	"github.com/joho/godotenv"
-	"github.com/pion/rtp"
-	"github.com/pion/webrtc/v3"
+	"github.com/glimesh/broadcast-box/internal/webrtc"
+)
+
+const (
+	// streamPollInterval is how often a relay checks if its stream went live
+	streamPollInterval = time.Second
+
+	// Failed connections are retried after minRetryDelay, doubled after every
+	// failure up to maxRetryDelay. A relay that stayed up for resetRetryDelayAfter
+	// starts over with minRetryDelay.
+	minRetryDelay        = time.Second
+	maxRetryDelay        = time.Minute
+	resetRetryDelayAfter = time.Minute
+
+	requestTimeout = 10 * time.Second
 
-	internal "github.com/glimesh/broadcast-box/internal/webrtc"
+	stateIdle       = "idle"
+	stateConnecting = "connecting"
+	stateLive       = "live"
+	stateError      = "error"
 )
 
-var payload = ""
+var errUnexpectedStatus = errors.New("WHIP endpoint responded with unexpected status")
 
-func InitRelay(whepClient *webrtc.API) {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+type relay struct {
+	target Target
+	stop   chan struct{}
+	done   chan struct{}
+
+	// previous is the relay this one replaces, its session ends first as the
+	// remote endpoint may not take two publishers at once
+	previous *relay
+
+	stateLock sync.Mutex
+	state     string
+	lastError string
+	retryAt   time.Time
+}
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+func newRelay(target Target, previous *relay) *relay {
+	r := &relay{target: target, stop: make(chan struct{}), done: make(chan struct{}), previous: previous, state: stateIdle}
+	go r.run()
+
+	return r
+}
+
+// close stops the relay and waits until the session on the remote endpoint is deleted
+func (r *relay) close() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *relay) setState(state string) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	r.state, r.lastError, r.retryAt = state, "", time.Time{}
+}
+
+func (r *relay) setError(err error, retryDelay time.Duration) {
+	log.Printf("Relay to %s failed: %s", r.target.URL, err)
+
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	r.state, r.lastError, r.retryAt = stateError, err.Error(), time.Now().Add(retryDelay)
+}
+
+// run keeps the stream relayed while it is live until the relay is stopped
+func (r *relay) run() {
+	defer close(r.done)
+
+	if r.previous != nil {
+		r.previous.close()
+		r.previous = nil
+
+		if r.stopped() {
+			return
+		}
 	}
 
-	endpoint := os.Getenv("Endpoint")
-	token := os.Getenv("Token")
+	retryDelay := minRetryDelay
+	for {
+		restream, offer, err := webrtc.NewRestream(r.target.StreamKey, r.target.Layer)
+		if errors.Is(err, webrtc.ErrStreamNotLive) {
+			r.setState(stateIdle)
+			if !r.wait(streamPollInterval) {
+				return
+			}
+			continue
+		} else if err != nil {
+			r.setError(err, retryDelay)
+			if !r.wait(retryDelay) {
+				return
+			}
+			retryDelay = nextRetryDelay(retryDelay)
+			continue
+		}
 
-	pc, err := whepClient.NewPeerConnection(webrtc.Configuration{})
+		r.setState(stateConnecting)
+		startedAt := time.Now()
+		err = r.relay(restream, offer)
 
-	videoTrack := internal.GetTrackMultiCodec()
+		if time.Since(startedAt) >= resetRetryDelayAfter {
+			retryDelay = minRetryDelay
+		}
 
-	pc.AddTransceiverFromTrack(videoTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		// A broadcast that ended is picked up again once it is live, only
+		// failures are retried with a delay
+		if r.stopped() {
+			return
+		} else if err == nil {
+			r.setState(stateIdle)
+			continue
+		}
 
-	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("PeerConnection State has changed %s \n", connectionState.String())
-	})
+		r.setError(err, retryDelay)
+		if !r.wait(retryDelay) {
+			return
+		}
+		retryDelay = nextRetryDelay(retryDelay)
+	}
+}
 
-	// TODO: Set up handler from other stream and relay here
+// relay sends the offer to the remote endpoint and forwards media until the
+// broadcast ends, the connection fails or the relay is stopped
+func (r *relay) relay(restream *webrtc.Restream, offer string) error {
+	defer restream.Close()
 
-	// Continue setup
-	offer, err := pc.CreateOffer(nil)
+	answer, resourceURL, err := r.post(offer)
+	if err != nil {
+		return err
+	}
+	defer r.delete(resourceURL)
 
-	err = pc.SetLocalDescription(offer)
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
-	<-gatherComplete
+	if err = restream.SetAnswer(answer); err != nil {
+		if errors.Is(err, webrtc.ErrStreamNotLive) {
+			return nil
+		}
+		return err
+	}
 
-	var sdp = []byte(pc.LocalDescription().SDP)
-	client := &http.Client{}
+	log.Printf("Relaying to %s", r.target.URL)
+	r.setState(stateLive)
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(sdp))
-	req.Header.Add("Content-Type", "application/sdp")
-	req.Header.Add("Authorization", "Bearer "+token)
+	select {
+	case <-restream.Done():
+		if restream.Failed() {
+			return errors.New("connection failed")
+		}
+		log.Printf("Relay to %s ended", r.target.URL)
+	case <-r.stop:
+	}
 
-	resp, err := client.Do(req)
+	return nil
+}
+
+// post sends the offer, the session on the remote endpoint is at resourceURL
+func (r *relay) post(offer string) (answer, resourceURL string, err error) {
+	req, err := r.newRequest(http.MethodPost, r.target.URL, bytes.NewBufferString(offer))
 	if err != nil {
-		log.Println(err)
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	} else if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("%w %d: %s", errUnexpectedStatus, resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	base, err := url.Parse(r.target.URL)
+	if err != nil {
+		return "", "", err
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(body), base.ResolveReference(location).String(), nil
+}
 
-	if resp.StatusCode != 201 {
-		log.Fatalf("Non Successful POST: %d", resp.StatusCode)
+// delete ends the session on the remote endpoint, it is gone anyway if this fails
+func (r *relay) delete(resourceURL string) {
+	req, err := r.newRequest(http.MethodDelete, resourceURL, nil)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	resourceUrl, err := url.Parse(resp.Header.Get("Location"))
-	base, err := url.Parse(endpoint)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
 
-	resourceUrl = base.ResolveReference(resourceUrl)
-	answer := webrtc.SessionDescription{}
-	answer.Type = webrtc.SDPTypeAnswer
-	answer.SDP = string(body)
+func (r *relay) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
 
-	err = pc.SetRemoteDescription(answer)
+	if r.target.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.target.Token)
+	}
+
+	return req, nil
 }
 
-func EmbedMetadata(rtpPkt *rtp.Packet) []byte {
-	rtpBuf := make([]byte, 1500)
+// wait returns false if the relay was stopped in the meantime
+func (r *relay) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	// Modify the frame here
-	frame := rtpBuf
-	message := []byte(payload)
-	start := []byte{0xCA, 0xFE, 0xBA, 0xBE}
-	data := append(start, message...)
-	data = append(data, []byte{0, 0, 0, byte(len(message))}...)
+	select {
+	case <-timer.C:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
 
-	// Create a new buffer to hold modified frame
-	newFrame := make([]byte, len(frame)+len(data))
-	copy(newFrame, frame)
-	copy(newFrame[len(frame):], data)
+func (r *relay) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
 
-	rtpBuf = frame
+func nextRetryDelay(retryDelay time.Duration) time.Duration {
+	if retryDelay *= 2; retryDelay > maxRetryDelay {
+		return maxRetryDelay
+	}
 
-	return rtpBuf
+	return retryDelay
 }
@@ -0,0 +1,288 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const protocolWHIP = "whip"
+
+var (
+	// ErrTargetNotFound is returned when a target that doesn't exist is updated or removed
+	ErrTargetNotFound = errors.New("relay target not found")
+	// ErrTargetInvalid is returned for targets without a stream key or URL
+	ErrTargetInvalid = errors.New("relay target requires a streamKey and url")
+	// ErrProtocolNotSupported is returned for targets that aren't WHIP endpoints
+	ErrProtocolNotSupported = errors.New("relay target protocol is not supported, only `whip` is")
+)
+
+type (
+	// Target is a remote endpoint a stream is sent to
+	Target struct {
+		ID        string `json:"id"`
+		StreamKey string `json:"streamKey"`
+		Protocol  string `json:"protocol"`
+		URL       string `json:"url"`
+		Token     string `json:"token"`
+
+		// Layer is the simulcast layer that is sent, it is chosen by the
+		// estimated bandwidth if empty
+		Layer string `json:"layer"`
+	}
+
+	// TargetStatus is a Target and the state of its relay, the token isn't
+	// included. RetryIn is the number of seconds until a failed relay is retried.
+	TargetStatus struct {
+		ID        string `json:"id"`
+		StreamKey string `json:"streamKey"`
+		Protocol  string `json:"protocol"`
+		URL       string `json:"url"`
+		Layer     string `json:"layer"`
+		State     string `json:"state"`
+		Error     string `json:"error,omitempty"`
+		RetryIn   int    `json:"retryIn,omitempty"`
+	}
+)
+
+var (
+	// relays are kept in the order they were added, that is the order of RELAY_TARGETS_FILE
+	relays     []*relay
+	relaysLock sync.Mutex
+
+	targetsFile string
+)
+
+// Configure starts relaying to the targets listed in RELAY_TARGETS_FILE.
+// Targets changed at runtime are written back to it, without it they are lost
+// on restart.
+func Configure() {
+	if targetsFile = os.Getenv("RELAY_TARGETS_FILE"); targetsFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(targetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	targets := []Target{}
+	if err = json.Unmarshal(data, &targets); err != nil {
+		log.Fatalf("RELAY_TARGETS_FILE is invalid: %s", err)
+	}
+
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	for _, target := range targets {
+		if err = normalizeTarget(&target); err != nil {
+			log.Fatalf("RELAY_TARGETS_FILE is invalid: %s", err)
+		}
+
+		if target.ID == "" {
+			target.ID = uuid.New().String()
+		}
+
+		relays = append(relays, newRelay(target, nil))
+	}
+}
+
+// Shutdown stops all relays and deletes their sessions on the remote endpoints
+func Shutdown() {
+	relaysLock.Lock()
+	stopping := relays
+	relays = nil
+	relaysLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range stopping {
+		wg.Add(1)
+		go func(r *relay) {
+			defer wg.Done()
+			r.close()
+		}(r)
+	}
+	wg.Wait()
+}
+
+// Targets lists the targets of streamKey, or all of them if it is empty
+func Targets(streamKey string) []TargetStatus {
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	statuses := []TargetStatus{}
+	for _, r := range relays {
+		if streamKey == "" || r.target.StreamKey == streamKey {
+			statuses = append(statuses, r.status())
+		}
+	}
+
+	return statuses
+}
+
+// AddTarget starts relaying to a new target once it is saved
+func AddTarget(target Target) (TargetStatus, error) {
+	if err := normalizeTarget(&target); err != nil {
+		return TargetStatus{}, err
+	}
+	target.ID = uuid.New().String()
+
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	if err := saveTargets(append(relayTargets(), target)); err != nil {
+		return TargetStatus{}, err
+	}
+
+	r := newRelay(target, nil)
+	relays = append(relays, r)
+
+	return r.status(), nil
+}
+
+// UpdateTarget replaces the target with id once it is saved, the relay
+// reconnects with the new settings once the old one closed, which doesn't hold
+// up the caller. The token is kept if target has none.
+func UpdateTarget(id string, target Target) (TargetStatus, error) {
+	if err := normalizeTarget(&target); err != nil {
+		return TargetStatus{}, err
+	}
+
+	relaysLock.Lock()
+	defer relaysLock.Unlock()
+
+	for i, r := range relays {
+		if r.target.ID != id {
+			continue
+		}
+
+		target.ID = id
+		if target.Token == "" {
+			target.Token = r.target.Token
+		}
+
+		targets := relayTargets()
+		targets[i] = target
+		if err := saveTargets(targets); err != nil {
+			return TargetStatus{}, err
+		}
+
+		relays[i] = newRelay(target, r)
+
+		return relays[i].status(), nil
+	}
+
+	return TargetStatus{}, ErrTargetNotFound
+}
+
+// RemoveTarget stops relaying to the target with id once it is saved. The relay
+// is closed after relaysLock is released, deleting its remote session may take
+// a while.
+func RemoveTarget(id string) error {
+	relaysLock.Lock()
+	for i, r := range relays {
+		if r.target.ID != id {
+			continue
+		}
+
+		targets := relayTargets()
+		if err := saveTargets(append(targets[:i], targets[i+1:]...)); err != nil {
+			relaysLock.Unlock()
+			return err
+		}
+
+		relays = append(relays[:i], relays[i+1:]...)
+		relaysLock.Unlock()
+
+		r.close()
+		return nil
+	}
+	relaysLock.Unlock()
+
+	return ErrTargetNotFound
+}
+
+func normalizeTarget(target *Target) error {
+	if target.Protocol == "" {
+		target.Protocol = protocolWHIP
+	}
+
+	if target.StreamKey == "" || target.URL == "" {
+		return ErrTargetInvalid
+	} else if target.Protocol != protocolWHIP {
+		return ErrProtocolNotSupported
+	}
+
+	return nil
+}
+
+// relayTargets returns the targets of the relays, it must be called with
+// relaysLock held
+func relayTargets() []Target {
+	targets := []Target{}
+	for _, r := range relays {
+		targets = append(targets, r.target)
+	}
+
+	return targets
+}
+
+// saveTargets writes targets to RELAY_TARGETS_FILE, it must be called with
+// relaysLock held. The file is replaced at once so a crash can't truncate it.
+func saveTargets(targets []Target) error {
+	if targetsFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp makes the file only readable by its owner, tokens are credentials
+	// of the remote endpoints
+	tmp, err := os.CreateTemp(filepath.Dir(targetsFile), filepath.Base(targetsFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	} else if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), targetsFile)
+}
+
+func (r *relay) status() TargetStatus {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	status := TargetStatus{
+		ID:        r.target.ID,
+		StreamKey: r.target.StreamKey,
+		Protocol:  r.target.Protocol,
+		URL:       r.target.URL,
+		Layer:     r.target.Layer,
+		State:     r.state,
+		Error:     r.lastError,
+	}
+
+	if !r.retryAt.IsZero() {
+		status.RetryIn = int(math.Ceil(time.Until(r.retryAt).Seconds()))
+	}
+
+	return status
+}
@@ -0,0 +1,197 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+)
+
+var (
+	errAMF0TooShort        = errors.New("AMF0 value is truncated")
+	errAMF0TypeUnsupported = errors.New("AMF0 type is not supported")
+)
+
+// decodeAMF0 reads all values of a command or data message. Numbers are
+// float64, objects and ECMA arrays map[string]interface{} and null and
+// undefined nil.
+func decodeAMF0(data []byte) (values []interface{}, err error) {
+	for len(data) != 0 {
+		var value interface{}
+		if value, data, err = decodeAMF0Value(data); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func decodeAMF0Value(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, errAMF0TooShort
+	}
+
+	marker, data := data[0], data[1:]
+	switch marker {
+	case amf0Number:
+		if len(data) < 8 {
+			return nil, nil, errAMF0TooShort
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	case amf0Boolean:
+		if len(data) < 1 {
+			return nil, nil, errAMF0TooShort
+		}
+		return data[0] != 0, data[1:], nil
+	case amf0String:
+		return decodeAMF0String(data, 2)
+	case amf0LongString:
+		return decodeAMF0String(data, 4)
+	case amf0Null, amf0Undefined:
+		return nil, data, nil
+	case amf0Object:
+		return decodeAMF0Properties(data)
+	case amf0ECMAArray:
+		if len(data) < 4 {
+			return nil, nil, errAMF0TooShort
+		}
+		// The count is only a hint, the properties end with an object end marker
+		return decodeAMF0Properties(data[4:])
+	case amf0StrictArray:
+		if len(data) < 4 {
+			return nil, nil, errAMF0TooShort
+		}
+
+		count := binary.BigEndian.Uint32(data)
+		data = data[4:]
+
+		values := []interface{}{}
+		for i := uint32(0); i < count; i++ {
+			var value interface{}
+			var err error
+			if value, data, err = decodeAMF0Value(data); err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+		}
+		return values, data, nil
+	case amf0Date:
+		if len(data) < 10 {
+			return nil, nil, errAMF0TooShort
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[10:], nil
+	}
+
+	return nil, nil, errAMF0TypeUnsupported
+}
+
+func decodeAMF0String(data []byte, lengthSize int) (interface{}, []byte, error) {
+	if len(data) < lengthSize {
+		return nil, nil, errAMF0TooShort
+	}
+
+	length := uint64(binary.BigEndian.Uint16(data))
+	if lengthSize == 4 {
+		length = uint64(binary.BigEndian.Uint32(data))
+	}
+
+	data = data[lengthSize:]
+	if uint64(len(data)) < length {
+		return nil, nil, errAMF0TooShort
+	}
+
+	return string(data[:length]), data[length:], nil
+}
+
+func decodeAMF0Properties(data []byte) (interface{}, []byte, error) {
+	properties := map[string]interface{}{}
+	for {
+		if len(data) < 3 {
+			return nil, nil, errAMF0TooShort
+		}
+
+		keyLength := int(binary.BigEndian.Uint16(data))
+		if keyLength == 0 && data[2] == amf0ObjectEnd {
+			return properties, data[3:], nil
+		} else if len(data) < 2+keyLength {
+			return nil, nil, errAMF0TooShort
+		}
+
+		key := string(data[2 : 2+keyLength])
+		value, rest, err := decodeAMF0Value(data[2+keyLength:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		properties[key] = value
+		data = rest
+	}
+}
+
+// encodeAMF0 writes the values of a command, it supports the types
+// decodeAMF0 returns
+func encodeAMF0(values ...interface{}) []byte {
+	data := []byte{}
+	for _, value := range values {
+		data = appendAMF0Value(data, value)
+	}
+
+	return data
+}
+
+func appendAMF0Value(data []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case float64:
+		data = append(data, amf0Number)
+		return binary.BigEndian.AppendUint64(data, math.Float64bits(v))
+	case int:
+		return appendAMF0Value(data, float64(v))
+	case bool:
+		if v {
+			return append(data, amf0Boolean, 1)
+		}
+		return append(data, amf0Boolean, 0)
+	case string:
+		if len(v) > math.MaxUint16 {
+			data = append(data, amf0LongString)
+			data = binary.BigEndian.AppendUint32(data, uint32(len(v)))
+			return append(data, v...)
+		}
+
+		data = append(data, amf0String)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(v)))
+		return append(data, v...)
+	case map[string]interface{}:
+		// Sorted so commands are encoded the same every time
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		data = append(data, amf0Object)
+		for _, key := range keys {
+			data = binary.BigEndian.AppendUint16(data, uint16(len(key)))
+			data = append(data, key...)
+			data = appendAMF0Value(data, v[key])
+		}
+		return append(data, 0, 0, amf0ObjectEnd)
+	}
+
+	return append(data, amf0Null)
+}
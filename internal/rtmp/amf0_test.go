@@ -0,0 +1,160 @@
+package rtmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAMF0(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		values []interface{}
+		err    error
+	}{
+		{
+			name:   "number",
+			data:   []byte{amf0Number, 0x3F, 0xF8, 0, 0, 0, 0, 0, 0},
+			values: []interface{}{1.5},
+		},
+		{
+			name:   "booleans",
+			data:   []byte{amf0Boolean, 1, amf0Boolean, 0},
+			values: []interface{}{true, false},
+		},
+		{
+			name:   "string",
+			data:   []byte{amf0String, 0, 7, 'c', 'o', 'n', 'n', 'e', 'c', 't'},
+			values: []interface{}{"connect"},
+		},
+		{
+			name:   "long string",
+			data:   []byte{amf0LongString, 0, 0, 0, 3, 'k', 'e', 'y'},
+			values: []interface{}{"key"},
+		},
+		{
+			name:   "null and undefined",
+			data:   []byte{amf0Null, amf0Undefined},
+			values: []interface{}{nil, nil},
+		},
+		{
+			name:   "object",
+			data:   []byte{amf0Object, 0, 3, 'a', 'p', 'p', amf0String, 0, 4, 'l', 'i', 'v', 'e', 0, 0, amf0ObjectEnd},
+			values: []interface{}{map[string]interface{}{"app": "live"}},
+		},
+		{
+			name:   "ECMA array",
+			data:   []byte{amf0ECMAArray, 0, 0, 0, 1, 0, 5, 'w', 'i', 'd', 't', 'h', amf0Number, 0x40, 0x9E, 0, 0, 0, 0, 0, 0, 0, 0, amf0ObjectEnd},
+			values: []interface{}{map[string]interface{}{"width": 1920.0}},
+		},
+		{
+			name:   "strict array",
+			data:   []byte{amf0StrictArray, 0, 0, 0, 2, amf0Null, amf0Boolean, 1},
+			values: []interface{}{[]interface{}{nil, true}},
+		},
+		{
+			name:   "date",
+			data:   []byte{amf0Date, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			values: []interface{}{0.0},
+		},
+		{
+			name: "empty",
+			data: []byte{},
+		},
+		{
+			name: "truncated number",
+			data: []byte{amf0Number, 0x3F, 0xF8},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "truncated boolean",
+			data: []byte{amf0Boolean},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "truncated string length",
+			data: []byte{amf0String, 0},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "string shorter than its length",
+			data: []byte{amf0String, 0, 7, 'c', 'o', 'n'},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "long string shorter than its length",
+			data: []byte{amf0LongString, 0xFF, 0xFF, 0xFF, 0xFF, 'k'},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "object without end",
+			data: []byte{amf0Object, 0, 3, 'a', 'p', 'p', amf0Null},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "object key shorter than its length",
+			data: []byte{amf0Object, 0, 9, 'a', 'p', 'p'},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "object with truncated value",
+			data: []byte{amf0Object, 0, 3, 'a', 'p', 'p', amf0Number, 0},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "truncated ECMA array count",
+			data: []byte{amf0ECMAArray, 0, 0},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "strict array with fewer values than its count",
+			data: []byte{amf0StrictArray, 0xFF, 0xFF, 0xFF, 0xFF, amf0Null},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "truncated date",
+			data: []byte{amf0Date, 0, 0, 0, 0},
+			err:  errAMF0TooShort,
+		},
+		{
+			name: "reference",
+			data: []byte{0x07, 0, 1},
+			err:  errAMF0TypeUnsupported,
+		},
+		{
+			name: "truncated after a value",
+			data: []byte{amf0Null, amf0String, 0, 1},
+			err:  errAMF0TooShort,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeAMF0(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			} else if !reflect.DeepEqual(values, test.values) {
+				t.Fatalf("expected %#v, got %#v", test.values, values)
+			}
+		})
+	}
+}
+
+func TestEncodeAMF0RoundTrip(t *testing.T) {
+	longString := string(make([]byte, 0x10000))
+
+	values, err := decodeAMF0(encodeAMF0(
+		"_result", 1, nil, true, longString,
+		map[string]interface{}{"level": "status", "code": "NetStream.Publish.Start", "objectEncoding": 0},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interface{}{
+		"_result", 1.0, nil, true, longString,
+		map[string]interface{}{"level": "status", "code": "NetStream.Publish.Start", "objectEncoding": 0.0},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, values)
+	}
+}
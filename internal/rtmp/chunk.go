@@ -0,0 +1,282 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	messageTypeSetChunkSize     = 1
+	messageTypeAbort            = 2
+	messageTypeAcknowledgement  = 3
+	messageTypeUserControl      = 4
+	messageTypeWindowAckSize    = 5
+	messageTypeSetPeerBandwidth = 6
+	messageTypeAudio            = 8
+	messageTypeVideo            = 9
+	messageTypeDataAMF3         = 15
+	messageTypeCommandAMF3      = 17
+	messageTypeDataAMF0         = 18
+	messageTypeCommandAMF0      = 20
+
+	chunkStreamIDProtocolControl = 2
+	chunkStreamIDCommand         = 3
+
+	defaultChunkSize = 128
+	outputChunkSize  = 4096
+	maxChunkSize     = 0xFFFFFF
+
+	extendedTimestamp = 0xFFFFFF
+
+	// Chunks arrive before the publish is authorized, these bound what a
+	// connection can make us hold. Encoders use a handful of chunk streams and
+	// keyframes are far below the message size limit.
+	maxChunkStreams   = 16
+	maxMessageLength  = 8 * 1024 * 1024
+	maxBufferedLength = 16 * 1024 * 1024
+)
+
+var (
+	errChunkSizeInvalid    = errors.New("RTMP chunk size is invalid")
+	errChunkStreamNotFound = errors.New("RTMP chunk continues a chunk stream that didn't start")
+	errTooManyChunkStreams = errors.New("RTMP connection uses too many chunk streams")
+	errMessageTooLarge     = errors.New("RTMP message is too large")
+	errBufferFull          = errors.New("RTMP connection has too many partial messages")
+)
+
+type (
+	// message is a RTMP message once all of its chunks arrived
+	message struct {
+		typeID    uint8
+		streamID  uint32
+		timestamp uint32
+		payload   []byte
+	}
+
+	// chunkStream is the header state of a chunk stream, later chunks only
+	// send what changed
+	chunkStream struct {
+		started           bool
+		timestamp         uint32
+		timestampDelta    uint32
+		length            uint32
+		typeID            uint8
+		streamID          uint32
+		extendedTimestamp bool
+		payload           []byte
+	}
+
+	// chunkReader assembles the messages of the chunk streams of a connection
+	chunkReader struct {
+		r            *bufio.Reader
+		chunkSize    uint32
+		chunkStreams map[uint32]*chunkStream
+
+		// buffered is the size of all partial messages
+		buffered int
+
+		// bytesRead is what the peer sent, it is acknowledged every windowAckSize bytes
+		bytesRead uint64
+	}
+
+	chunkWriter struct {
+		w *bufio.Writer
+	}
+)
+
+func newChunkReader(r *bufio.Reader) *chunkReader {
+	return &chunkReader{r: r, chunkSize: defaultChunkSize, chunkStreams: map[uint32]*chunkStream{}}
+}
+
+func (c *chunkReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+
+	c.bytesRead += uint64(n)
+	return b, nil
+}
+
+// readMessage reads chunks until one completes a message
+func (c *chunkReader) readMessage() (*message, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+func (c *chunkReader) readChunk() (*message, error) {
+	basicHeader, err := c.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	format, chunkStreamID := basicHeader[0]>>6, uint32(basicHeader[0]&0x3F)
+	switch chunkStreamID {
+	case 0:
+		b, err := c.read(1)
+		if err != nil {
+			return nil, err
+		}
+		chunkStreamID = 64 + uint32(b[0])
+	case 1:
+		b, err := c.read(2)
+		if err != nil {
+			return nil, err
+		}
+		chunkStreamID = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	cs, ok := c.chunkStreams[chunkStreamID]
+	if !ok {
+		if len(c.chunkStreams) >= maxChunkStreams {
+			return nil, errTooManyChunkStreams
+		}
+
+		cs = &chunkStream{}
+		c.chunkStreams[chunkStreamID] = cs
+	}
+
+	if format != 0 && !cs.started {
+		return nil, errChunkStreamNotFound
+	}
+	cs.started = true
+
+	headerSizes := [4]int{11, 7, 3, 0}
+	header, err := c.read(headerSizes[format])
+	if err != nil {
+		return nil, err
+	}
+
+	timestampField := uint32(0)
+	if format != 3 {
+		timestampField = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extendedTimestamp = timestampField == extendedTimestamp
+	}
+	if format <= 1 {
+		// A new message header drops the partial message of the chunk stream
+		c.dropPayload(cs)
+
+		if cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5]); cs.length > maxMessageLength {
+			return nil, errMessageTooLarge
+		}
+		cs.typeID = header[6]
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(header[7:])
+	}
+
+	if cs.extendedTimestamp {
+		b, err := c.read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		if format != 3 {
+			timestampField = binary.BigEndian.Uint32(b)
+		}
+	}
+
+	// The timestamp only advances with the first chunk of a message
+	if len(cs.payload) == 0 {
+		switch format {
+		case 0:
+			// Like FFmpeg and librtmp a type 3 chunk after type 0 repeats its timestamp as delta
+			cs.timestamp = timestampField
+			cs.timestampDelta = timestampField
+		case 1, 2:
+			cs.timestampDelta = timestampField
+			cs.timestamp += timestampField
+		case 3:
+			cs.timestamp += cs.timestampDelta
+		}
+	}
+
+	size := cs.length - uint32(len(cs.payload))
+	if size > c.chunkSize {
+		size = c.chunkSize
+	}
+
+	if c.buffered+int(size) > maxBufferedLength {
+		return nil, errBufferFull
+	}
+
+	data, err := c.read(int(size))
+	if err != nil {
+		return nil, err
+	}
+	cs.payload = append(cs.payload, data...)
+	c.buffered += len(data)
+
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &message{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.payload}
+	c.dropPayload(cs)
+	return msg, nil
+}
+
+// abort drops the partial message of a chunk stream
+func (c *chunkReader) abort(chunkStreamID uint32) {
+	if cs, ok := c.chunkStreams[chunkStreamID]; ok {
+		c.dropPayload(cs)
+	}
+}
+
+func (c *chunkReader) dropPayload(cs *chunkStream) {
+	c.buffered -= len(cs.payload)
+	cs.payload = nil
+}
+
+func (c *chunkReader) setChunkSize(size uint32) error {
+	// The most significant bit must be zero
+	if size == 0 || size > maxChunkSize {
+		return errChunkSizeInvalid
+	}
+
+	c.chunkSize = size
+	return nil
+}
+
+// writeMessage sends a message in chunks of outputChunkSize, the peer is
+// told about that size before anything else
+func (c *chunkWriter) writeMessage(chunkStreamID uint8, typeID uint8, streamID uint32, payload []byte) error {
+	header := []byte{chunkStreamID & 0x3F, 0, 0, 0, byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typeID}
+	header = binary.LittleEndian.AppendUint32(header, streamID)
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(payload); offset += outputChunkSize {
+		if offset != 0 {
+			if err := c.w.WriteByte(0xC0 | chunkStreamID&0x3F); err != nil {
+				return err
+			}
+		}
+
+		end := offset + outputChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		if _, err := c.w.Write(payload[offset:end]); err != nil {
+			return err
+		}
+	}
+
+	return c.w.Flush()
+}
+
+func (c *chunkWriter) writeProtocolControl(typeID uint8, payload []byte) error {
+	return c.writeMessage(chunkStreamIDProtocolControl, typeID, 0, payload)
+}
+
+func (c *chunkWriter) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(chunkStreamIDCommand, messageTypeCommandAMF0, streamID, encodeAMF0(values...))
+}
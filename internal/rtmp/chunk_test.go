@@ -0,0 +1,236 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// chunkType0 is the basic and message header of a chunk starting a message
+func chunkType0(chunkStreamID byte, timestamp, length uint32, typeID byte, streamID uint32) []byte {
+	header := []byte{chunkStreamID, byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(length >> 16), byte(length >> 8), byte(length), typeID}
+	return binary.LittleEndian.AppendUint32(header, streamID)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestChunkReader(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 200)
+	tooManyChunkStreams := []byte{}
+	for chunkStreamID := byte(3); chunkStreamID < 3+maxChunkStreams+1; chunkStreamID++ {
+		tooManyChunkStreams = append(tooManyChunkStreams, chunkType0(chunkStreamID, 0, 0, messageTypeVideo, 1)...)
+	}
+
+	for _, test := range []struct {
+		name      string
+		data      []byte
+		chunkSize uint32
+		messages  []*message
+		err       error
+	}{
+		{
+			name:     "single chunk",
+			data:     join(chunkType0(3, 1000, 3, messageTypeCommandAMF0, 0), []byte("abc")),
+			messages: []*message{{typeID: messageTypeCommandAMF0, timestamp: 1000, payload: []byte("abc")}},
+		},
+		{
+			name:     "message split across chunks",
+			data:     join(chunkType0(4, 0, 200, messageTypeVideo, 1), long[:128], []byte{0xC4}, long[128:]),
+			messages: []*message{{typeID: messageTypeVideo, streamID: 1, payload: long}},
+		},
+		{
+			name:      "larger chunk size",
+			data:      join(chunkType0(4, 0, 200, messageTypeVideo, 1), long),
+			chunkSize: 4096,
+			messages:  []*message{{typeID: messageTypeVideo, streamID: 1, payload: long}},
+		},
+		{
+			name: "headers add timestamp deltas",
+			data: join(
+				chunkType0(6, 100, 1, messageTypeAudio, 1), []byte("a"),
+				[]byte{0x46, 0, 0, 20, 0, 0, 1, messageTypeAudio}, []byte("b"),
+				[]byte{0x86, 0, 0, 21}, []byte("c"),
+				[]byte{0xC6}, []byte("d"),
+			),
+			messages: []*message{
+				{typeID: messageTypeAudio, streamID: 1, timestamp: 100, payload: []byte("a")},
+				{typeID: messageTypeAudio, streamID: 1, timestamp: 120, payload: []byte("b")},
+				{typeID: messageTypeAudio, streamID: 1, timestamp: 141, payload: []byte("c")},
+				{typeID: messageTypeAudio, streamID: 1, timestamp: 162, payload: []byte("d")},
+			},
+		},
+		{
+			name: "extended timestamp",
+			data: join(chunkType0(3, extendedTimestamp, 1, messageTypeVideo, 1), []byte{0x01, 0, 0, 0}, []byte("a")),
+			messages: []*message{
+				{typeID: messageTypeVideo, streamID: 1, timestamp: 0x01000000, payload: []byte("a")},
+			},
+		},
+		{
+			name: "interleaved chunk streams",
+			data: join(
+				chunkType0(4, 0, 200, messageTypeVideo, 1), long[:128],
+				chunkType0(3, 0, 1, messageTypeAudio, 1), []byte("a"),
+				[]byte{0xC4}, long[128:],
+			),
+			messages: []*message{
+				{typeID: messageTypeAudio, streamID: 1, payload: []byte("a")},
+				{typeID: messageTypeVideo, streamID: 1, payload: long},
+			},
+		},
+		{
+			name:     "two byte chunk stream ID",
+			data:     join([]byte{0, 1}, chunkType0(1, 0, 1, messageTypeAudio, 1)[1:], []byte("a")),
+			messages: []*message{{typeID: messageTypeAudio, streamID: 1, payload: []byte("a")}},
+		},
+		{
+			name:     "three byte chunk stream ID",
+			data:     join([]byte{1, 0, 1}, chunkType0(1, 0, 1, messageTypeAudio, 1)[1:], []byte("a")),
+			messages: []*message{{typeID: messageTypeAudio, streamID: 1, payload: []byte("a")}},
+		},
+		{
+			name: "new message drops partial message",
+			data: join(
+				chunkType0(4, 0, 200, messageTypeVideo, 1), long[:128],
+				chunkType0(4, 0, 1, messageTypeVideo, 1), []byte("a"),
+			),
+			messages: []*message{{typeID: messageTypeVideo, streamID: 1, payload: []byte("a")}},
+		},
+		{
+			name: "continues chunk stream that didn't start",
+			data: []byte{0xC5},
+			err:  errChunkStreamNotFound,
+		},
+		{
+			name: "truncated three byte chunk stream ID",
+			data: []byte{1, 0},
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "truncated header",
+			data: chunkType0(3, 0, 3, messageTypeCommandAMF0, 0)[:6],
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "truncated extended timestamp",
+			data: join(chunkType0(3, extendedTimestamp, 1, messageTypeVideo, 1), []byte{0x01}),
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "truncated payload",
+			data: join(chunkType0(3, 0, 10, messageTypeCommandAMF0, 0), []byte("abc")),
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "message too large",
+			data: chunkType0(3, 0, maxMessageLength+1, messageTypeVideo, 1),
+			err:  errMessageTooLarge,
+		},
+		{
+			name: "too many chunk streams",
+			data: tooManyChunkStreams,
+			messages: func() (messages []*message) {
+				for i := 0; i < maxChunkStreams; i++ {
+					messages = append(messages, &message{typeID: messageTypeVideo, streamID: 1, payload: []byte{}})
+				}
+				return messages
+			}(),
+			err: errTooManyChunkStreams,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader := newChunkReader(bufio.NewReader(bytes.NewReader(test.data)))
+			if test.chunkSize != 0 {
+				if err := reader.setChunkSize(test.chunkSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var messages []*message
+			for {
+				msg, err := reader.readMessage()
+				if err != nil {
+					if expected := test.err; !errors.Is(err, expected) && !(expected == nil && errors.Is(err, io.EOF)) {
+						t.Fatalf("expected %v, got %v", expected, err)
+					}
+					break
+				}
+
+				if msg.payload == nil {
+					msg.payload = []byte{}
+				}
+				messages = append(messages, msg)
+			}
+
+			if !reflect.DeepEqual(messages, test.messages) {
+				t.Fatalf("expected %+v, got %+v", test.messages, messages)
+			}
+		})
+	}
+}
+
+func TestChunkReaderLimitsBufferedBytes(t *testing.T) {
+	chunk := make([]byte, maxBufferedLength/4)
+
+	data := []byte{}
+	for chunkStreamID := byte(3); chunkStreamID < 8; chunkStreamID++ {
+		data = append(data, chunkType0(chunkStreamID, 0, maxMessageLength, messageTypeVideo, 1)...)
+		data = append(data, chunk...)
+	}
+
+	reader := newChunkReader(bufio.NewReader(bytes.NewReader(data)))
+	if err := reader.setChunkSize(uint32(len(chunk))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reader.readMessage(); !errors.Is(err, errBufferFull) {
+		t.Fatalf("expected %v, got %v", errBufferFull, err)
+	} else if reader.buffered != maxBufferedLength {
+		t.Fatalf("expected %d bytes buffered, got %d", maxBufferedLength, reader.buffered)
+	}
+
+	// Aborted messages no longer count
+	reader.abort(3)
+	if reader.buffered != maxBufferedLength-len(chunk) {
+		t.Fatalf("expected %d bytes buffered, got %d", maxBufferedLength-len(chunk), reader.buffered)
+	}
+}
+
+func TestSetChunkSize(t *testing.T) {
+	reader := newChunkReader(nil)
+	for _, size := range []uint32{0, maxChunkSize + 1} {
+		if err := reader.setChunkSize(size); !errors.Is(err, errChunkSizeInvalid) {
+			t.Fatalf("chunk size %d: expected %v, got %v", size, errChunkSizeInvalid, err)
+		}
+	}
+}
+
+func TestChunkWriterRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, outputChunkSize*2+1)
+
+	output := &bytes.Buffer{}
+	if err := (&chunkWriter{w: bufio.NewWriter(output)}).writeMessage(chunkStreamIDCommand, messageTypeDataAMF0, 1, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newChunkReader(bufio.NewReader(output))
+	if err := reader.setChunkSize(outputChunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := reader.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &message{typeID: messageTypeDataAMF0, streamID: 1, payload: payload}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, msg)
+	}
+}
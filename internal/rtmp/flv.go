@@ -0,0 +1,123 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	flvVideoFrameTypeKeyframe = 1
+	flvVideoCodecH264         = 7
+
+	flvAVCPacketTypeSequenceHeader = 0
+	flvAVCPacketTypeNALU           = 1
+
+	flvSoundFormatAAC = 10
+
+	// Enhanced RTMP signals Opus with SoundFormat ExHeader and a FourCC
+	flvSoundFormatExHeader        = 9
+	flvAudioPacketTypeCodedFrames = 1
+	flvFourCCOpus                 = "Opus"
+
+	h264NALUTypeSPS = 7
+)
+
+var (
+	errAVCConfigTooShort = errors.New("AVCDecoderConfigurationRecord is truncated")
+	errAVCNALUTooShort   = errors.New("H264 NAL unit is truncated")
+)
+
+// avcConfig is what the AVC sequence header tells about the H264 that follows
+type avcConfig struct {
+	naluLengthSize int
+	sps, pps       []byte
+}
+
+// parseAVCConfig reads the first SPS and PPS of an AVCDecoderConfigurationRecord
+func parseAVCConfig(data []byte) (*avcConfig, error) {
+	if len(data) < 6 {
+		return nil, errAVCConfigTooShort
+	}
+
+	config := &avcConfig{naluLengthSize: int(data[4]&0x03) + 1}
+	numSPS, data := int(data[5]&0x1F), data[6:]
+
+	readParameterSets := func(count int) ([]byte, error) {
+		var first []byte
+		for i := 0; i < count; i++ {
+			if len(data) < 2 {
+				return nil, errAVCConfigTooShort
+			}
+
+			length := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+length {
+				return nil, errAVCConfigTooShort
+			}
+
+			if first == nil {
+				first = append([]byte{}, data[2:2+length]...)
+			}
+			data = data[2+length:]
+		}
+
+		return first, nil
+	}
+
+	var err error
+	if config.sps, err = readParameterSets(numSPS); err != nil {
+		return nil, err
+	} else if len(data) < 1 {
+		return nil, errAVCConfigTooShort
+	}
+
+	numPPS := int(data[0])
+	data = data[1:]
+	if config.pps, err = readParameterSets(numPPS); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// splitNALUs splits length prefixed NAL units
+func splitNALUs(data []byte, lengthSize int) (nalus [][]byte, err error) {
+	for len(data) != 0 {
+		if len(data) < lengthSize {
+			return nil, errAVCNALUTooShort
+		}
+
+		length := 0
+		for i := 0; i < lengthSize; i++ {
+			length = length<<8 | int(data[i])
+		}
+
+		data = data[lengthSize:]
+		if len(data) < length {
+			return nil, errAVCNALUTooShort
+		}
+
+		if length != 0 {
+			nalus = append(nalus, data[:length])
+		}
+		data = data[length:]
+	}
+
+	return nalus, nil
+}
+
+// withParameterSets puts the SPS and PPS in front of a keyframe that doesn't
+// carry them, encoders often only send them in the sequence header but WebRTC
+// viewers need them with every keyframe
+func withParameterSets(nalus [][]byte, config *avcConfig) [][]byte {
+	for _, nalu := range nalus {
+		if nalu[0]&0x1F == h264NALUTypeSPS {
+			return nalus
+		}
+	}
+
+	if len(config.sps) == 0 || len(config.pps) == 0 {
+		return nalus
+	}
+
+	return append([][]byte{config.sps, config.pps}, nalus...)
+}
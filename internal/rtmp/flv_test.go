@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1F}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+)
+
+func TestParseAVCConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		config *avcConfig
+		err    error
+	}{
+		{
+			name:   "one SPS and PPS",
+			data:   []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x42, 0xC0, 0x1F, 1, 0, 4, 0x68, 0xCE, 0x3C, 0x80},
+			config: &avcConfig{naluLengthSize: 4, sps: testSPS, pps: testPPS},
+		},
+		{
+			name:   "first of two SPS",
+			data:   []byte{1, 0x42, 0xC0, 0x1F, 0xFD, 0xE2, 0, 4, 0x67, 0x42, 0xC0, 0x1F, 0, 1, 0x67, 1, 0, 4, 0x68, 0xCE, 0x3C, 0x80},
+			config: &avcConfig{naluLengthSize: 2, sps: testSPS, pps: testPPS},
+		},
+		{
+			name:   "no parameter sets",
+			data:   []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE0, 0},
+			config: &avcConfig{naluLengthSize: 4},
+		},
+		{
+			name: "truncated header",
+			data: []byte{1, 0x42, 0xC0, 0x1F},
+			err:  errAVCConfigTooShort,
+		},
+		{
+			name: "truncated SPS length",
+			data: []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0},
+			err:  errAVCConfigTooShort,
+		},
+		{
+			name: "SPS shorter than its length",
+			data: []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 9, 0x67, 0x42},
+			err:  errAVCConfigTooShort,
+		},
+		{
+			name: "missing PPS count",
+			data: []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x42, 0xC0, 0x1F},
+			err:  errAVCConfigTooShort,
+		},
+		{
+			name: "fewer PPS than their count",
+			data: []byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x42, 0xC0, 0x1F, 2, 0, 4, 0x68, 0xCE, 0x3C, 0x80},
+			err:  errAVCConfigTooShort,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parseAVCConfig(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			} else if !reflect.DeepEqual(config, test.config) {
+				t.Fatalf("expected %+v, got %+v", test.config, config)
+			}
+		})
+	}
+}
+
+func TestSplitNALUs(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		data       []byte
+		lengthSize int
+		nalus      [][]byte
+		err        error
+	}{
+		{
+			name:       "four byte lengths",
+			data:       []byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 1, 0x06},
+			lengthSize: 4,
+			nalus:      [][]byte{{0x65, 1}, {0x06}},
+		},
+		{
+			name:       "two byte lengths",
+			data:       []byte{0, 3, 0x41, 1, 2},
+			lengthSize: 2,
+			nalus:      [][]byte{{0x41, 1, 2}},
+		},
+		{
+			name:       "empty NAL units are skipped",
+			data:       []byte{0, 0, 0, 0, 0, 0, 0, 1, 0x41},
+			lengthSize: 4,
+			nalus:      [][]byte{{0x41}},
+		},
+		{
+			name:       "empty",
+			data:       []byte{},
+			lengthSize: 4,
+		},
+		{
+			name:       "truncated length",
+			data:       []byte{0, 0, 0, 1, 0x41, 0, 0},
+			lengthSize: 4,
+			err:        errAVCNALUTooShort,
+		},
+		{
+			name:       "NAL unit shorter than its length",
+			data:       []byte{0, 0, 0, 9, 0x41, 1},
+			lengthSize: 4,
+			err:        errAVCNALUTooShort,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nalus, err := splitNALUs(test.data, test.lengthSize)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			} else if !reflect.DeepEqual(nalus, test.nalus) {
+				t.Fatalf("expected %v, got %v", test.nalus, nalus)
+			}
+		})
+	}
+}
+
+func TestWithParameterSets(t *testing.T) {
+	idr := []byte{0x65, 1}
+	config := &avcConfig{naluLengthSize: 4, sps: testSPS, pps: testPPS}
+
+	for _, test := range []struct {
+		name     string
+		nalus    [][]byte
+		config   *avcConfig
+		expected [][]byte
+	}{
+		{
+			name:     "keyframe without parameter sets",
+			nalus:    [][]byte{idr},
+			config:   config,
+			expected: [][]byte{testSPS, testPPS, idr},
+		},
+		{
+			name:     "keyframe with parameter sets",
+			nalus:    [][]byte{testSPS, testPPS, idr},
+			config:   config,
+			expected: [][]byte{testSPS, testPPS, idr},
+		},
+		{
+			name:     "sequence header without parameter sets",
+			nalus:    [][]byte{idr},
+			config:   &avcConfig{naluLengthSize: 4},
+			expected: [][]byte{idr},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if nalus := withParameterSets(test.nalus, test.config); !reflect.DeepEqual(nalus, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, nalus)
+			}
+		})
+	}
+}
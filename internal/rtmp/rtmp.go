@@ -0,0 +1,363 @@
+// Package rtmp accepts publishes from encoders that only speak RTMP. It
+// handles the handshake, the chunk streams and the commands of a publish and
+// passes the H264 and Opus it receives to a Publisher.
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	rtmpVersion   = 3
+	handshakeSize = 1536
+
+	windowAckSize   = 2_500_000
+	publishStreamID = 1
+
+	userControlStreamBegin = 0
+
+	// readTimeout closes connections of encoders that stopped sending
+	readTimeout = 30 * time.Second
+)
+
+var (
+	errRTMPVersionUnsupported = errors.New("RTMP version is not supported")
+	errAlreadyPublishing      = errors.New("RTMP connection is already publishing")
+	errPublishEnded           = errors.New("RTMP publish ended")
+)
+
+type (
+	// Publisher receives the media of a publish
+	Publisher interface {
+		// WriteH264 is called with the NAL units of a frame in decode order
+		// and its decode time, keyframes come with their SPS and PPS
+		WriteH264(nalus [][]byte, dts time.Duration) error
+		WriteOpus(packet []byte, pts time.Duration) error
+		Close()
+	}
+
+	// PublishHandler authorizes a publish and returns where its media goes.
+	// flashVersion identifies the encoder, disconnect ends the connection.
+	PublishHandler func(streamKey, remoteAddress, flashVersion string, disconnect func()) (Publisher, error)
+
+	conn struct {
+		netConn net.Conn
+		reader  *chunkReader
+		writer  *chunkWriter
+		handler PublishHandler
+
+		windowAckSize uint32
+		lastAckAt     uint64
+
+		flashVersion string
+		publisher    Publisher
+		avcConfig    *avcConfig
+
+		// Media that can't be forwarded is only logged once
+		videoDropped, audioDropped bool
+	}
+)
+
+// ListenAndServe accepts RTMP connections on address until listening fails
+func ListenAndServe(address string, handler PublishHandler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serve(netConn, handler)
+	}
+}
+
+func serve(netConn net.Conn, handler PublishHandler) {
+	c := &conn{
+		netConn: netConn,
+		reader:  newChunkReader(bufio.NewReader(netConn)),
+		writer:  &chunkWriter{w: bufio.NewWriter(netConn)},
+		handler: handler,
+	}
+	defer c.close()
+
+	if err := c.run(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, errPublishEnded) {
+		log.Println(err)
+	}
+}
+
+func (c *conn) run() error {
+	if err := c.netConn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return err
+	}
+
+	if err := c.handshake(); err != nil {
+		return err
+	}
+
+	for {
+		if err := c.netConn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		msg, err := c.reader.readMessage()
+		if err != nil {
+			return err
+		}
+
+		if err = c.handleMessage(msg); err != nil {
+			return err
+		}
+
+		if c.windowAckSize != 0 && c.reader.bytesRead-c.lastAckAt >= uint64(c.windowAckSize) {
+			c.lastAckAt = c.reader.bytesRead
+			if err = c.writer.writeProtocolControl(messageTypeAcknowledgement, binary.BigEndian.AppendUint32(nil, uint32(c.reader.bytesRead))); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake answers C0 and C1 with S0, S1 and S2, which echoes C1. Encoders
+// accept this simple handshake on rtmp:// URLs.
+func (c *conn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.reader.r, c0c1); err != nil {
+		return err
+	} else if c0c1[0] != rtmpVersion {
+		return errRTMPVersionUnsupported
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = rtmpVersion
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+
+	if _, err := c.writer.w.Write(s0s1s2); err != nil {
+		return err
+	} else if err = c.writer.w.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.reader.r, c2)
+	return err
+}
+
+func (c *conn) handleMessage(msg *message) error {
+	switch msg.typeID {
+	case messageTypeSetChunkSize:
+		if len(msg.payload) < 4 {
+			return errChunkSizeInvalid
+		}
+		return c.reader.setChunkSize(binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF)
+	case messageTypeAbort:
+		if len(msg.payload) >= 4 {
+			c.reader.abort(binary.BigEndian.Uint32(msg.payload))
+		}
+	case messageTypeWindowAckSize:
+		if len(msg.payload) >= 4 {
+			c.windowAckSize = binary.BigEndian.Uint32(msg.payload)
+		}
+	case messageTypeCommandAMF0:
+		return c.handleCommand(msg.streamID, msg.payload)
+	case messageTypeCommandAMF3:
+		// AMF3 commands are AMF0 behind a format byte
+		if len(msg.payload) != 0 {
+			return c.handleCommand(msg.streamID, msg.payload[1:])
+		}
+	case messageTypeVideo:
+		return c.handleVideo(msg)
+	case messageTypeAudio:
+		return c.handleAudio(msg)
+	}
+
+	return nil
+}
+
+func (c *conn) handleCommand(streamID uint32, payload []byte) error {
+	values, err := decodeAMF0(payload)
+	if err != nil {
+		return err
+	} else if len(values) < 2 {
+		return nil
+	}
+
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if properties, ok := values[2].(map[string]interface{}); ok {
+				c.flashVersion, _ = properties["flashVer"].(string)
+			}
+		}
+		return c.connect(transactionID)
+	case "createStream":
+		return c.writer.writeCommand(0, "_result", transactionID, nil, publishStreamID)
+	case "publish":
+		streamKey := ""
+		if len(values) > 3 {
+			streamKey, _ = values[3].(string)
+		}
+		return c.publish(streamID, streamKey)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return errPublishEnded
+	}
+
+	// releaseStream, FCPublish and the like only need an answer if one is expected
+	if transactionID != 0 {
+		return c.writer.writeCommand(0, "_result", transactionID, nil)
+	}
+
+	return nil
+}
+
+func (c *conn) connect(transactionID float64) error {
+	if err := c.writer.writeProtocolControl(messageTypeWindowAckSize, binary.BigEndian.AppendUint32(nil, windowAckSize)); err != nil {
+		return err
+	}
+
+	// Dynamic limit type
+	if err := c.writer.writeProtocolControl(messageTypeSetPeerBandwidth, append(binary.BigEndian.AppendUint32(nil, windowAckSize), 2)); err != nil {
+		return err
+	}
+
+	if err := c.writer.writeProtocolControl(messageTypeSetChunkSize, binary.BigEndian.AppendUint32(nil, outputChunkSize)); err != nil {
+		return err
+	}
+
+	return c.writer.writeCommand(0, "_result", transactionID,
+		map[string]interface{}{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+		map[string]interface{}{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0},
+	)
+}
+
+func (c *conn) publish(streamID uint32, streamKey string) error {
+	if c.publisher != nil {
+		return errAlreadyPublishing
+	}
+
+	// Some encoders send parameters after the stream key
+	streamKey, _, _ = strings.Cut(streamKey, "?")
+
+	publisher, err := c.handler(streamKey, c.netConn.RemoteAddr().String(), c.flashVersion, c.disconnect)
+	if err != nil {
+		if writeErr := c.writer.writeCommand(streamID, "onStatus", 0, nil, map[string]interface{}{"level": "error", "code": "NetStream.Publish.BadName", "description": err.Error()}); writeErr != nil {
+			log.Println(writeErr)
+		}
+		return err
+	}
+	c.publisher = publisher
+
+	if err := c.writer.writeProtocolControl(messageTypeUserControl, binary.BigEndian.AppendUint32([]byte{0, userControlStreamBegin}, streamID)); err != nil {
+		return err
+	}
+
+	return c.writer.writeCommand(streamID, "onStatus", 0, nil, map[string]interface{}{"level": "status", "code": "NetStream.Publish.Start", "description": "Publishing started."})
+}
+
+func (c *conn) handleVideo(msg *message) error {
+	payload := msg.payload
+	if c.publisher == nil || len(payload) < 5 {
+		return nil
+	}
+
+	// Enhanced RTMP sets the high bit and sends a FourCC instead of a codec ID
+	if payload[0]&0x80 != 0 || payload[0]&0x0F != flvVideoCodecH264 {
+		c.logDropped(&c.videoDropped, "RTMP video is dropped, only H264 is supported")
+		return nil
+	}
+
+	switch payload[1] {
+	case flvAVCPacketTypeSequenceHeader:
+		config, err := parseAVCConfig(payload[5:])
+		if err != nil {
+			return err
+		}
+		c.avcConfig = config
+	case flvAVCPacketTypeNALU:
+		if c.avcConfig == nil {
+			return nil
+		}
+
+		nalus, err := splitNALUs(payload[5:], c.avcConfig.naluLengthSize)
+		if err != nil {
+			return err
+		} else if len(nalus) == 0 {
+			return nil
+		}
+
+		if payload[0]>>4 == flvVideoFrameTypeKeyframe {
+			nalus = withParameterSets(nalus, c.avcConfig)
+		}
+
+		// The composition time offset is left out, RTP is timed in decode order
+		return c.publisher.WriteH264(nalus, time.Duration(msg.timestamp)*time.Millisecond)
+	}
+
+	return nil
+}
+
+func (c *conn) handleAudio(msg *message) error {
+	payload := msg.payload
+	if c.publisher == nil || len(payload) < 1 {
+		return nil
+	}
+
+	switch payload[0] >> 4 {
+	case flvSoundFormatExHeader:
+		if len(payload) < 5 || string(payload[1:5]) != flvFourCCOpus {
+			c.logDropped(&c.audioDropped, "RTMP audio is dropped, only Opus is supported")
+			return nil
+		}
+
+		// The sequence start only carries the OpusHead, WebRTC doesn't need it
+		if payload[0]&0x0F == flvAudioPacketTypeCodedFrames {
+			return c.publisher.WriteOpus(payload[5:], time.Duration(msg.timestamp)*time.Millisecond)
+		}
+	case flvSoundFormatAAC:
+		// Most encoders send AAC, their video is still worth watching
+		c.logDropped(&c.audioDropped, "RTMP audio is dropped, WebRTC can't carry AAC. Configure the encoder for Opus over Enhanced RTMP to broadcast audio")
+	default:
+		c.logDropped(&c.audioDropped, "RTMP audio is dropped, only Opus is supported")
+	}
+
+	return nil
+}
+
+func (c *conn) logDropped(logged *bool, reason string) {
+	if !*logged {
+		*logged = true
+		log.Println(reason)
+	}
+}
+
+// disconnect is called when the publisher is replaced or the stream ends
+func (c *conn) disconnect() {
+	if err := c.netConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Println(err)
+	}
+}
+
+func (c *conn) close() {
+	if c.publisher != nil {
+		c.publisher.Close()
+	}
+
+	c.disconnect()
+}
@@ -0,0 +1,80 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingPublisher keeps the timestamps of what it is written
+type recordingPublisher struct {
+	h264, opus []time.Duration
+}
+
+func (p *recordingPublisher) WriteH264(_ [][]byte, dts time.Duration) error {
+	p.h264 = append(p.h264, dts)
+	return nil
+}
+
+func (p *recordingPublisher) WriteOpus(_ []byte, pts time.Duration) error {
+	p.opus = append(p.opus, pts)
+	return nil
+}
+
+func (p *recordingPublisher) Close() {}
+
+func publishingConn() (*conn, *bytes.Buffer, *recordingPublisher) {
+	output, publisher := &bytes.Buffer{}, &recordingPublisher{}
+	return &conn{writer: &chunkWriter{w: bufio.NewWriter(output)}, publisher: publisher}, output, publisher
+}
+
+func TestAACAudioIsDropped(t *testing.T) {
+	c, output, publisher := publishingConn()
+	c.avcConfig = &avcConfig{naluLengthSize: 4, sps: testSPS, pps: testPPS}
+
+	for _, msg := range []*message{
+		{typeID: messageTypeDataAMF0, streamID: 1, payload: encodeAMF0("@setDataFrame", "onMetaData", map[string]interface{}{"audiocodecid": 10, "videocodecid": 7})},
+		{typeID: messageTypeAudio, streamID: 1, payload: []byte{flvSoundFormatAAC<<4 | 0x0F, 0, 0x12, 0x10}},
+		{typeID: messageTypeAudio, streamID: 1, timestamp: 21, payload: []byte{flvSoundFormatAAC<<4 | 0x0F, 1, 0x21}},
+		{typeID: messageTypeVideo, streamID: 1, timestamp: 33, payload: []byte{flvVideoFrameTypeKeyframe<<4 | flvVideoCodecH264, flvAVCPacketTypeNALU, 0, 0, 0, 0, 0, 0, 2, 0x65, 1}},
+	} {
+		if err := c.handleMessage(msg); err != nil {
+			t.Fatalf("publish ended: %v", err)
+		}
+	}
+
+	if output.Len() != 0 {
+		t.Fatalf("encoder was sent % x", output.Bytes())
+	} else if len(publisher.opus) != 0 || len(publisher.h264) != 1 {
+		t.Fatalf("expected only the video to be written, got %d audio and %d video frames", len(publisher.opus), len(publisher.h264))
+	}
+}
+
+func TestH264IsTimedByDecodeTime(t *testing.T) {
+	c, _, publisher := publishingConn()
+	c.avcConfig = &avcConfig{naluLengthSize: 4, sps: testSPS, pps: testPPS}
+
+	// An I, P, B order with composition time offsets that put the B-frame
+	// before the P-frame
+	for _, frame := range []struct {
+		timestamp       uint32
+		frameType       byte
+		compositionTime byte
+	}{
+		{timestamp: 0, frameType: flvVideoFrameTypeKeyframe, compositionTime: 66},
+		{timestamp: 33, frameType: 2, compositionTime: 99},
+		{timestamp: 66, frameType: 2, compositionTime: 0},
+	} {
+		payload := []byte{frame.frameType<<4 | flvVideoCodecH264, flvAVCPacketTypeNALU, 0, 0, frame.compositionTime, 0, 0, 0, 2, 0x41, 1}
+		if err := c.handleMessage(&message{typeID: messageTypeVideo, streamID: 1, timestamp: frame.timestamp, payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []time.Duration{0, 33 * time.Millisecond, 66 * time.Millisecond}
+	if !reflect.DeepEqual(publisher.h264, expected) {
+		t.Fatalf("expected %v, got %v", expected, publisher.h264)
+	}
+}
@@ -0,0 +1,210 @@
+package webrtc
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultDataChannelMaxMessageSize    = 16 * 1024
+	defaultDataChannelMessagesPerSecond = 30
+
+	// dataChannelMaxBufferedAmount is how much may be queued for a peer before
+	// messages to it are dropped, so one slow viewer doesn't hold up the rest
+	dataChannelMaxBufferedAmount = 1024 * 1024
+
+	// maxDataChannels is how many data channels a peer may have open, further
+	// channels are closed right away
+	maxDataChannels = 16
+)
+
+var (
+	dataChannelMaxMessageSize    = defaultDataChannelMaxMessageSize
+	dataChannelMessagesPerSecond = defaultDataChannelMessagesPerSecond
+
+	// dataChannelViewerMessages forwards the messages of viewers to the publisher
+	dataChannelViewerMessages bool
+)
+
+type (
+	// dataChannels are the open data channels of a peer by label, the
+	// messages of a publisher are sent to the channels of its viewers with the
+	// same label
+	dataChannels struct {
+		lock     sync.RWMutex
+		channels map[string]*webrtc.DataChannel
+
+		// count is how many channels the peer has that didn't close yet
+		count int
+
+		// All channels of a peer share one limit, opening more of them
+		// doesn't raise it
+		limiter messageLimiter
+	}
+
+	// messageLimiter is a token bucket that allows dataChannelMessagesPerSecond
+	// messages with bursts of as many
+	messageLimiter struct {
+		lock    sync.Mutex
+		started bool
+		tokens  float64
+		last    time.Time
+	}
+)
+
+func configureDataChannels() {
+	var err error
+	if os.Getenv("DATA_CHANNEL_MAX_MESSAGE_SIZE") != "" {
+		if dataChannelMaxMessageSize, err = strconv.Atoi(os.Getenv("DATA_CHANNEL_MAX_MESSAGE_SIZE")); err != nil || dataChannelMaxMessageSize <= 0 {
+			log.Fatal("DATA_CHANNEL_MAX_MESSAGE_SIZE must be a positive number of bytes")
+		}
+	}
+
+	if os.Getenv("DATA_CHANNEL_MESSAGES_PER_SECOND") != "" {
+		if dataChannelMessagesPerSecond, err = strconv.Atoi(os.Getenv("DATA_CHANNEL_MESSAGES_PER_SECOND")); err != nil || dataChannelMessagesPerSecond < 0 {
+			log.Fatal("DATA_CHANNEL_MESSAGES_PER_SECOND must be a number of messages, 0 disables the limit")
+		}
+	}
+
+	dataChannelViewerMessages = os.Getenv("DATA_CHANNEL_VIEWER_MESSAGES") != ""
+}
+
+// add keeps dataChannel while it is open. Messages that are too large or
+// arrive faster than the rate limit are dropped, the rest go to onMessage.
+// Channels beyond maxDataChannels are closed.
+func (d *dataChannels) add(dataChannel *webrtc.DataChannel, onMessage func(webrtc.DataChannelMessage)) {
+	label := dataChannel.Label()
+
+	d.lock.Lock()
+	if d.count >= maxDataChannels {
+		d.lock.Unlock()
+
+		if err := dataChannel.Close(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	d.count++
+	d.lock.Unlock()
+
+	dataChannel.OnOpen(func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		if d.channels == nil {
+			d.channels = map[string]*webrtc.DataChannel{}
+		}
+		d.channels[label] = dataChannel
+	})
+
+	dataChannel.OnClose(func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		d.count--
+		if d.channels[label] == dataChannel {
+			delete(d.channels, label)
+		}
+	})
+
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) > dataChannelMaxMessageSize || !d.limiter.allow() {
+			return
+		}
+
+		onMessage(msg)
+	})
+}
+
+// send delivers msg on the channel with label, if the peer opened one
+func (d *dataChannels) send(label string, msg webrtc.DataChannelMessage) {
+	d.lock.RLock()
+	dataChannel, ok := d.channels[label]
+	d.lock.RUnlock()
+
+	if !ok || dataChannel.BufferedAmount() > dataChannelMaxBufferedAmount {
+		return
+	}
+
+	var err error
+	if msg.IsString {
+		err = dataChannel.SendText(string(msg.Data))
+	} else {
+		err = dataChannel.Send(msg.Data)
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendDataChannelMessage fans a message of the active publisher out to the viewers
+func (s *stream) sendDataChannelMessage(label string, msg webrtc.DataChannelMessage) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for _, w := range s.whepSessions {
+		w.dataChannels.send(label, msg)
+	}
+}
+
+// onPublisherDataChannel relays the messages of the publisher's data channels
+// to the viewers while it is the active publisher
+func (s *stream) onPublisherDataChannel(w *whipSession) func(*webrtc.DataChannel) {
+	return func(dataChannel *webrtc.DataChannel) {
+		w.dataChannels.add(dataChannel, func(msg webrtc.DataChannelMessage) {
+			if s.whipSession.Load() == w {
+				s.sendDataChannelMessage(dataChannel.Label(), msg)
+			}
+		})
+	}
+}
+
+// onViewerDataChannel relays the messages of a viewer's data channels to the
+// active publisher when DATA_CHANNEL_VIEWER_MESSAGES is set
+func (s *stream) onViewerDataChannel(w *whepSession) func(*webrtc.DataChannel) {
+	return func(dataChannel *webrtc.DataChannel) {
+		w.dataChannels.add(dataChannel, func(msg webrtc.DataChannelMessage) {
+			if !dataChannelViewerMessages {
+				return
+			}
+
+			if publisher := s.whipSession.Load(); publisher != nil {
+				publisher.dataChannels.send(dataChannel.Label(), msg)
+			}
+		})
+	}
+}
+
+func (l *messageLimiter) allow() bool {
+	if dataChannelMessagesPerSecond == 0 {
+		return true
+	}
+
+	// Channels of a peer deliver their messages concurrently
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	rate := float64(dataChannelMessagesPerSecond)
+	if !l.started {
+		// The bucket starts full
+		l.started, l.tokens = true, rate
+	} else {
+		l.tokens = math.Min(rate, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,27 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageLimiter(t *testing.T) {
+	dataChannelMessagesPerSecond = 10
+	t.Cleanup(func() { dataChannelMessagesPerSecond = defaultDataChannelMessagesPerSecond })
+
+	d := &dataChannels{}
+	for i := 0; i < 10; i++ {
+		if !d.limiter.allow() {
+			t.Fatalf("message %d of the burst was dropped", i)
+		}
+	}
+
+	if d.limiter.allow() {
+		t.Fatal("message beyond the burst was allowed")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !d.limiter.allow() {
+		t.Fatal("message after the bucket refilled was dropped")
+	}
+}
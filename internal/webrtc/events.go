@@ -0,0 +1,160 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const whepEventBufferSize = 32
+
+// WHEPEvent is a server-sent event delivered to a WHEP session
+type WHEPEvent struct {
+	Event string
+	Data  string
+}
+
+// WHEPSubscribe returns the events for a WHEP session, starting with the current
+// state of the stream. The channel is closed when the session ends, the returned
+// func must be called once the caller stops reading.
+func WHEPSubscribe(whepSessionId string) (<-chan WHEPEvent, func(), error) {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for playbackID := range streamMap {
+		s := streamMap[playbackID]
+
+		s.whepSessionsLock.RLock()
+		w, ok := s.whepSessions[whepSessionId]
+		viewerCount := len(s.whepSessions)
+		s.whepSessionsLock.RUnlock()
+
+		if !ok {
+			continue
+		}
+
+		events := make(chan WHEPEvent, whepEventBufferSize)
+		events <- s.layersEvent(w)
+		events <- s.activeEvent()
+		events <- viewerCountEvent(viewerCount)
+		if layer, _ := w.currentLayer.Load().(string); layer != "" {
+			events <- layerChangedEvent(layer)
+		}
+
+		w.eventsLock.Lock()
+		defer w.eventsLock.Unlock()
+
+		if w.eventsClosed {
+			close(events)
+			return events, func() {}, nil
+		}
+
+		w.eventSubscribers[events] = struct{}{}
+		return events, func() {
+			w.eventsLock.Lock()
+			defer w.eventsLock.Unlock()
+
+			delete(w.eventSubscribers, events)
+		}, nil
+	}
+
+	return nil, nil, errWHEPSessionNotFound
+}
+
+// sendEvent never blocks, events are dropped for subscribers that fall behind
+func (w *whepSession) sendEvent(event WHEPEvent) {
+	w.eventsLock.Lock()
+	defer w.eventsLock.Unlock()
+
+	for events := range w.eventSubscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (w *whepSession) closeEvents() {
+	w.eventsLock.Lock()
+	defer w.eventsLock.Unlock()
+
+	for events := range w.eventSubscribers {
+		close(events)
+	}
+	w.eventSubscribers = nil
+	w.eventsClosed = true
+}
+
+func (s *stream) sendEvent(event WHEPEvent) {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for i := range s.whepSessions {
+		s.whepSessions[i].sendEvent(event)
+	}
+}
+
+func (s *stream) sendViewerCount() {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	event := viewerCountEvent(len(s.whepSessions))
+	for i := range s.whepSessions {
+		s.whepSessions[i].sendEvent(event)
+	}
+}
+
+func (s *stream) sendLayersEvent() {
+	s.whepSessionsLock.RLock()
+	defer s.whepSessionsLock.RUnlock()
+
+	for i := range s.whepSessions {
+		s.whepSessions[i].sendEvent(s.layersEvent(s.whepSessions[i]))
+	}
+}
+
+// layersEvent lists the layers of the active publisher in a codec the viewer can decode
+func (s *stream) layersEvent(viewer *whepSession) WHEPEvent {
+	layers := []simulcastLayerResponse{}
+	if w := s.whipSession.Load(); w != nil {
+		w.videoTracksLock.RLock()
+		for _, t := range w.videoTracks {
+			if viewer.videoCodecs[t.codec] {
+				layers = append(layers, simulcastLayerResponse{EncodingId: t.layer, Codec: string(t.codec)})
+			}
+		}
+		w.videoTracksLock.RUnlock()
+	}
+
+	data, err := json.Marshal(map[string]map[string][]simulcastLayerResponse{
+		"1": {
+			"layers": layers,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return WHEPEvent{Event: "layers", Data: string(data)}
+}
+
+func (s *stream) activeEvent() WHEPEvent {
+	if s.isActive() {
+		return WHEPEvent{Event: "active", Data: "{}"}
+	}
+
+	return WHEPEvent{Event: "inactive", Data: "{}"}
+}
+
+func viewerCountEvent(viewerCount int) WHEPEvent {
+	return WHEPEvent{Event: "viewercount", Data: fmt.Sprintf(`{"viewercount":%d}`, viewerCount)}
+}
+
+func layerChangedEvent(layer string) WHEPEvent {
+	data, err := json.Marshal(whepLayerChangedResponse{MediaId: "1", EncodingId: layer})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return WHEPEvent{Event: "layer-changed", Data: string(data)}
+}
@@ -0,0 +1,192 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	h264NALUTypePPS = 8
+
+	av1OBUTypeTemporalDelimiter = 2
+)
+
+var errAV1FragmentLost = errors.New("AV1 OBU fragment lost its start")
+
+// mediaFrame is a frame of video or a packet of audio as it is stored in MP4
+type mediaFrame struct {
+	data      []byte
+	timestamp uint32
+	keyframe  bool
+}
+
+// frameAssembler depacketizes the RTP packets of a track into frames, H264
+// becomes length prefixed NAL units and AV1 OBUs with size fields. Frames that
+// lost a packet are dropped, packets arriving out of order count as lost.
+type frameAssembler struct {
+	// codec is empty for Opus, every packet of it is a frame
+	codec videoCodec
+
+	started            bool
+	lastSequenceNumber uint16
+
+	inFrame bool
+	broken  bool
+	frame   mediaFrame
+	h264    codecs.H264Packet
+	av1OBU  []byte
+
+	// The parameter sets seen last, the recording is configured with them
+	sps, pps, sequenceHeader []byte
+}
+
+func newFrameAssembler(codec videoCodec) *frameAssembler {
+	return &frameAssembler{codec: codec, h264: codecs.H264Packet{IsAVC: true}}
+}
+
+// push adds a packet, a frame is returned once its last packet arrived. lost
+// reports that a frame had to be dropped.
+func (a *frameAssembler) push(rtpPkt *rtp.Packet) (frame *mediaFrame, lost bool) {
+	if a.codec == "" {
+		return &mediaFrame{data: append([]byte{}, rtpPkt.Payload...), timestamp: rtpPkt.Timestamp, keyframe: true}, false
+	}
+
+	switch {
+	case !a.started:
+		a.started = true
+	case !sequenceNumberNewer(rtpPkt.SequenceNumber, a.lastSequenceNumber):
+		return nil, false
+	case rtpPkt.SequenceNumber != a.lastSequenceNumber+1:
+		// The frame of this packet may have lost its start too
+		lost = true
+		a.startFrame(rtpPkt)
+		a.broken = true
+	case a.inFrame && rtpPkt.Timestamp != a.frame.timestamp:
+		// The last packet of the previous frame didn't have the marker bit
+		lost = true
+		a.inFrame = false
+	}
+	a.lastSequenceNumber = rtpPkt.SequenceNumber
+
+	if !a.inFrame {
+		a.startFrame(rtpPkt)
+	}
+
+	if !a.broken {
+		if err := a.depacketize(rtpPkt.Payload); err != nil {
+			a.broken = true
+		}
+	}
+
+	if !rtpPkt.Marker {
+		return nil, lost
+	}
+
+	a.inFrame = false
+	if a.broken || len(a.frame.data) == 0 {
+		return nil, true
+	}
+
+	a.saveParameterSets()
+	frame = &mediaFrame{}
+	*frame = a.frame
+	return frame, lost
+}
+
+func (a *frameAssembler) startFrame(rtpPkt *rtp.Packet) {
+	a.inFrame = true
+	a.broken = false
+	a.frame = mediaFrame{timestamp: rtpPkt.Timestamp, keyframe: isKeyframe(rtpPkt.Payload, a.codec)}
+	a.h264 = codecs.H264Packet{IsAVC: true}
+	a.av1OBU = nil
+}
+
+func (a *frameAssembler) depacketize(payload []byte) error {
+	if a.codec == videoCodecH264 {
+		data, err := a.h264.Unmarshal(payload)
+		a.frame.data = append(a.frame.data, data...)
+		return err
+	}
+
+	av1Packet := codecs.AV1Packet{}
+	if _, err := av1Packet.Unmarshal(payload); err != nil {
+		return err
+	}
+
+	for i, element := range av1Packet.OBUElements {
+		if i == 0 && av1Packet.Z {
+			if a.av1OBU == nil {
+				return errAV1FragmentLost
+			}
+			a.av1OBU = append(a.av1OBU, element...)
+		} else {
+			a.av1OBU = append([]byte{}, element...)
+		}
+
+		if i != len(av1Packet.OBUElements)-1 || !av1Packet.Y {
+			a.appendAV1OBU(a.av1OBU)
+			a.av1OBU = nil
+		}
+	}
+
+	return nil
+}
+
+// appendAV1OBU adds an OBU to the frame with obu_has_size_field set, temporal
+// delimiters are left out as MP4 doesn't store them
+func (a *frameAssembler) appendAV1OBU(obu []byte) {
+	if len(obu) == 0 || obu[0]>>3&0x0F == av1OBUTypeTemporalDelimiter {
+		return
+	}
+
+	headerSize := 1
+	if obu[0]&0x04 != 0 {
+		headerSize++
+	}
+
+	if len(obu) < headerSize {
+		return
+	}
+
+	start := len(a.frame.data)
+	if obu[0]&0x02 != 0 {
+		a.frame.data = append(a.frame.data, obu...)
+	} else {
+		// LEB128 is the encoding of Uvarint
+		a.frame.data = append(a.frame.data, obu[0]|0x02)
+		a.frame.data = append(a.frame.data, obu[1:headerSize]...)
+		a.frame.data = binary.AppendUvarint(a.frame.data, uint64(len(obu)-headerSize))
+		a.frame.data = append(a.frame.data, obu[headerSize:]...)
+	}
+
+	if obu[0]>>3&0x0F == av1OBUTypeSequenceHeader {
+		a.sequenceHeader = append([]byte{}, a.frame.data[start:]...)
+	}
+}
+
+// saveParameterSets keeps the SPS and PPS of a H264 frame
+func (a *frameAssembler) saveParameterSets() {
+	if a.codec != videoCodecH264 {
+		return
+	}
+
+	for data := a.frame.data; len(data) > 4; {
+		naluSize := int(binary.BigEndian.Uint32(data))
+		if naluSize == 0 || naluSize > len(data)-4 {
+			return
+		}
+
+		nalu := data[4 : 4+naluSize]
+		switch nalu[0] & 0x1F {
+		case h264NALUTypeSPS:
+			a.sps = append([]byte{}, nalu...)
+		case h264NALUTypePPS:
+			a.pps = append([]byte{}, nalu...)
+		}
+
+		data = data[4+naluSize:]
+	}
+}
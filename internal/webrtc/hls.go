@@ -0,0 +1,693 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/fmp4"
+	"github.com/pion/rtp"
+)
+
+const (
+	hlsPartTarget    = 500 * time.Millisecond
+	hlsSegmentTarget = 2 * time.Second
+
+	// hlsTargetDuration is EXT-X-TARGETDURATION, segments run longer than
+	// hlsSegmentTarget if the publisher is late with a keyframe
+	hlsTargetDuration = 4 * time.Second
+
+	// Segments that are kept, the parts are only listed for the newest ones
+	hlsSegmentsKept         = 7
+	hlsSegmentsListingParts = 3
+
+	// A packager stops once nobody requested anything for hlsIdleTimeout
+	hlsIdleTimeout = 30 * time.Second
+
+	hlsAudioRendition        = "audio"
+	hlsVideoRenditionPrefix  = "video/"
+	hlsAudioBandwidth        = 64_000
+	hlsDefaultVideoBandwidth = 2_000_000
+
+	hlsTrackID = 1
+)
+
+var (
+	// ErrHLSNotFound is returned for streams, renditions and files that don't exist
+	ErrHLSNotFound = errors.New("hls file not found")
+	// ErrHLSBlockingRequestInvalid is returned when a blocking playlist reload
+	// asks for a segment too far in the future
+	ErrHLSBlockingRequestInvalid = errors.New("hls blocking request is too far ahead of the live edge")
+	// ErrHLSQueryInvalid is returned for a _HLS_msn or _HLS_part that is
+	// negative or not a number and for a _HLS_part without _HLS_msn
+	ErrHLSQueryInvalid = errors.New("hls _HLS_msn or _HLS_part is invalid")
+	// ErrHLSTimeout is returned when a blocking request wasn't fulfilled in time
+	ErrHLSTimeout = errors.New("hls request timed out")
+)
+
+type (
+	// hlsPackager cuts the H264 layers and the Opus audio of a stream into
+	// CMAF segments and parts for LL-HLS. Every layer is a video rendition
+	// and the audio a rendition of its own. It is started by the first HLS
+	// request for a stream and stops once nobody is watching.
+	hlsPackager struct {
+		startedAt     time.Time
+		lastRequestAt atomic.Int64
+
+		// lock guards everything below, changed is closed and replaced
+		// whenever a part is added
+		lock       sync.Mutex
+		changed    chan struct{}
+		closed     bool
+		renditions map[string]*hlsRendition
+	}
+
+	hlsRendition struct {
+		name  string
+		layer string
+
+		// Video is only packaged from a keyframe on that comes with its SPS
+		// and PPS, a new init segment is created if they change
+		assembler     *frameAssembler
+		needKeyframe  bool
+		parameterSets string
+		codecs        string
+		width, height uint16
+		track         *fmp4.Track
+		initNumber    int
+		initSegments  map[int][]byte
+
+		// The last sample is pending until the next one tells its duration
+		lastTimestamp uint32
+		decodeTime    uint64
+		pending       *fmp4.Sample
+
+		partSamples    []fmp4.Sample
+		partDecodeTime uint64
+		partDuration   uint32
+		sequenceNumber uint32
+
+		segments      []*hlsSegment
+		current       *hlsSegment
+		nextMSN       uint64
+		discontinuity bool
+	}
+
+	hlsSegment struct {
+		msn           uint64
+		initNumber    int
+		discontinuity bool
+		duration      time.Duration
+		parts         []*hlsPart
+	}
+
+	hlsPart struct {
+		data        []byte
+		duration    time.Duration
+		independent bool
+	}
+)
+
+func newHLSPackager() *hlsPackager {
+	p := &hlsPackager{
+		startedAt:  time.Now(),
+		changed:    make(chan struct{}),
+		renditions: map[string]*hlsRendition{},
+	}
+	p.lastRequestAt.Store(time.Now().UnixNano())
+
+	return p
+}
+
+// HLS serves a playlist or media file of the stream watched with
+// playbackIDOrToken. msn and part are the _HLS_msn and _HLS_part of blocking
+// playlist reloads, -1 if they weren't sent.
+func HLS(ctx context.Context, playbackIDOrToken, file string, msn, part int64) (body []byte, contentType string, err error) {
+	playbackID, claims, err := playbackIDFromBearerToken(playbackIDOrToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	streamMapLock.Lock()
+	s, ok := streamMap[playbackID]
+	if !ok {
+		streamMapLock.Unlock()
+		return nil, "", ErrHLSNotFound
+	} else if s.private && claims == nil {
+		streamMapLock.Unlock()
+		return nil, "", ErrPlaybackTokenRequired
+	}
+
+	p := s.hlsPackager.Load()
+	if p == nil {
+		p = newHLSPackager()
+		s.hlsPackager.Store(p)
+		s.sendPLI("")
+		go s.expireHLSPackager(p)
+	}
+	p.lastRequestAt.Store(time.Now().UnixNano())
+	streamMapLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*hlsTargetDuration)
+	defer cancel()
+
+	if file == "index.m3u8" {
+		layerBitrates := map[string]uint64{}
+		for _, l := range s.layerBitrates(map[videoCodec]bool{videoCodecH264: true}) {
+			layerBitrates[l.layer] = l.bitrate
+		}
+
+		return p.multivariantPlaylist(ctx, layerBitrates)
+	}
+
+	renditionName, fileName := file[:strings.LastIndex(file, "/")+1], file[strings.LastIndex(file, "/")+1:]
+	return p.renditionFile(ctx, strings.TrimSuffix(renditionName, "/"), fileName, msn, part)
+}
+
+// expireHLSPackager stops p once it wasn't requested for hlsIdleTimeout
+func (s *stream) expireHLSPackager(p *hlsPackager) {
+	for {
+		idle := time.Since(time.Unix(0, p.lastRequestAt.Load()))
+		if idle < hlsIdleTimeout {
+			time.Sleep(hlsIdleTimeout - idle)
+			continue
+		}
+
+		if s.hlsPackager.CompareAndSwap(p, nil) {
+			p.close()
+		}
+		return
+	}
+}
+
+// packageHLSVideo passes a packet of a video layer to the packager, returns
+// true if the layer should be asked for a keyframe
+func (s *stream) packageHLSVideo(videoTrack *whipVideoTrack, rtpPkt *rtp.Packet) (requestKeyframe bool) {
+	p := s.hlsPackager.Load()
+	if p == nil || videoTrack.codec != videoCodecH264 {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	name := hlsVideoRenditionPrefix + videoTrack.layer
+	r, ok := p.renditions[name]
+	if !ok {
+		r = &hlsRendition{name: name, layer: videoTrack.layer, initSegments: map[int][]byte{}}
+		p.renditions[name] = r
+	}
+
+	if r.assembler == nil {
+		r.assembler = newFrameAssembler(videoTrack.codec)
+		r.needKeyframe = true
+	}
+
+	frame, lost := r.assembler.push(rtpPkt)
+	if lost {
+		r.needKeyframe = true
+	}
+
+	if frame == nil {
+		return lost
+	} else if r.needKeyframe && !frame.keyframe {
+		return true
+	}
+	r.needKeyframe = false
+
+	if frame.keyframe {
+		if err := r.configureVideo(); err != nil {
+			r.needKeyframe = true
+			return true
+		}
+	}
+
+	if r.track == nil {
+		return false
+	}
+
+	p.add(r, frame, fmp4.VideoTimeScale)
+
+	// Ask for the keyframe that ends the segment a little early, it takes a while to arrive
+	return r.bufferedSegmentDuration() >= hlsSegmentTarget-hlsPartTarget
+}
+
+// packageHLSAudio passes an Opus packet to the packager
+func (s *stream) packageHLSAudio(rtpPkt *rtp.Packet) {
+	p := s.hlsPackager.Load()
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	r, ok := p.renditions[hlsAudioRendition]
+	if !ok {
+		r = &hlsRendition{name: hlsAudioRendition, codecs: "opus", initSegments: map[int][]byte{}}
+		r.track = fmp4.NewOpusTrack(hlsTrackID, recordingAudioChannels)
+		r.initSegments[r.initNumber] = fmp4.InitSegment(r.track)
+		p.renditions[hlsAudioRendition] = r
+	}
+
+	p.add(r, &mediaFrame{data: append([]byte{}, rtpPkt.Payload...), timestamp: rtpPkt.Timestamp, keyframe: true}, fmp4.OpusTimeScale)
+}
+
+// configureVideo creates the track and init segment of a video rendition from
+// the parameter sets of a keyframe. If they changed a new segment is started.
+func (r *hlsRendition) configureVideo() error {
+	parameterSets := string(r.assembler.sps) + string(r.assembler.pps)
+	if r.track != nil && parameterSets == r.parameterSets {
+		return nil
+	}
+
+	track, err := fmp4.NewH264Track(hlsTrackID, r.assembler.sps, r.assembler.pps)
+	if err != nil {
+		return err
+	}
+
+	if r.track != nil {
+		r.finishSegment(false)
+		r.initNumber++
+	}
+
+	r.track, r.parameterSets = track, parameterSets
+	r.codecs = "avc1." + hex.EncodeToString(r.assembler.sps[1:4])
+	r.width, r.height = track.Size()
+	r.initSegments[r.initNumber] = fmp4.InitSegment(track)
+	return nil
+}
+
+// add appends a frame to the rendition. Parts are cut before they would exceed
+// hlsPartTarget, segments at the first keyframe after hlsSegmentTarget.
+func (p *hlsPackager) add(r *hlsRendition, frame *mediaFrame, timeScale uint32) {
+	if r.pending == nil {
+		// Renditions share the clock of the packager, so players can switch between them
+		decodeTime := uint64(time.Since(p.startedAt).Seconds() * float64(timeScale))
+		if decodeTime > r.decodeTime {
+			r.decodeTime = decodeTime
+		}
+	} else {
+		duration := frame.timestamp - r.lastTimestamp
+		if int32(duration) <= 0 {
+			return
+		}
+
+		r.pending.Duration = duration
+		if len(r.partSamples) != 0 && r.ticksToDuration(r.partDuration+duration) > hlsPartTarget {
+			p.flushPart(r)
+		}
+
+		if len(r.partSamples) == 0 {
+			r.partDecodeTime = r.decodeTime
+		}
+		r.partSamples = append(r.partSamples, *r.pending)
+		r.partDuration += duration
+		r.decodeTime += uint64(duration)
+	}
+
+	if frame.keyframe && r.bufferedSegmentDuration() >= hlsSegmentTarget {
+		p.flushPart(r)
+		r.finishSegment(false)
+	}
+
+	r.lastTimestamp = frame.timestamp
+	r.pending = &fmp4.Sample{Keyframe: frame.keyframe, Data: frame.data}
+}
+
+func (r *hlsRendition) ticksToDuration(ticks uint32) time.Duration {
+	return time.Duration(float64(ticks) / float64(r.track.TimeScale) * float64(time.Second))
+}
+
+// bufferedSegmentDuration is the duration of the current segment so far
+func (r *hlsRendition) bufferedSegmentDuration() time.Duration {
+	duration := r.ticksToDuration(r.partDuration)
+	if r.current != nil {
+		duration += r.current.duration
+	}
+
+	return duration
+}
+
+// flushPart turns the buffered samples into a part of the current segment
+func (p *hlsPackager) flushPart(r *hlsRendition) {
+	if len(r.partSamples) == 0 {
+		return
+	}
+
+	if r.current == nil {
+		r.current = &hlsSegment{msn: r.nextMSN, initNumber: r.initNumber, discontinuity: r.discontinuity}
+		r.discontinuity = false
+	}
+
+	r.sequenceNumber++
+	part := &hlsPart{
+		data:        fmp4.Fragment(r.sequenceNumber, fmp4.TrackFragment{Track: r.track, BaseDecodeTime: r.partDecodeTime, Samples: r.partSamples}),
+		duration:    r.ticksToDuration(r.partDuration),
+		independent: r.partSamples[0].Keyframe,
+	}
+
+	r.current.parts = append(r.current.parts, part)
+	r.current.duration += part.duration
+	r.partSamples, r.partDuration = nil, 0
+
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// finishSegment adds the current segment to the playlist. A discontinuity
+// drops the pending sample, the next publisher continues on the packager clock.
+func (r *hlsRendition) finishSegment(discontinuity bool) {
+	if discontinuity {
+		r.pending = nil
+		r.discontinuity = true
+	}
+
+	if r.current == nil {
+		return
+	}
+
+	r.segments = append(r.segments, r.current)
+	r.current = nil
+	r.nextMSN++
+
+	if len(r.segments) > hlsSegmentsKept {
+		r.segments = r.segments[len(r.segments)-hlsSegmentsKept:]
+
+		for initNumber := range r.initSegments {
+			if initNumber < r.segments[0].initNumber {
+				delete(r.initSegments, initNumber)
+			}
+		}
+	}
+}
+
+// publisherChanged ends the segments of all renditions, the next publisher
+// starts after a discontinuity
+func (p *hlsPackager) publisherChanged() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, r := range p.renditions {
+		p.flushPart(r)
+		r.finishSegment(true)
+		r.assembler = nil
+	}
+}
+
+// trackRemoved drops the rendition of a layer the publisher stopped sending
+func (p *hlsPackager) trackRemoved(layer string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.renditions, hlsVideoRenditionPrefix+layer)
+}
+
+func (p *hlsPackager) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait blocks until ready returns true, it is called with p.lock held
+func (p *hlsPackager) wait(ctx context.Context, ready func() bool) error {
+	for !ready() {
+		if p.closed {
+			return ErrHLSNotFound
+		}
+
+		changed := p.changed
+		p.lock.Unlock()
+		select {
+		case <-changed:
+			p.lock.Lock()
+		case <-ctx.Done():
+			p.lock.Lock()
+			return ErrHLSTimeout
+		}
+	}
+
+	return nil
+}
+
+// isReady reports if the rendition can be played
+func (r *hlsRendition) isReady() bool {
+	return r.track != nil && (len(r.segments) != 0 || r.current != nil)
+}
+
+func (p *hlsPackager) multivariantPlaylist(ctx context.Context, layerBitrates map[string]uint64) ([]byte, string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	videoRenditions := []*hlsRendition{}
+	err := p.wait(ctx, func() bool {
+		videoRenditions = videoRenditions[:0]
+		for _, r := range p.renditions {
+			if r.layer != "" && r.isReady() {
+				videoRenditions = append(videoRenditions, r)
+			}
+		}
+
+		return len(videoRenditions) != 0
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	bandwidth := func(r *hlsRendition) uint64 {
+		if bitrate, ok := layerBitrates[r.layer]; ok {
+			return bitrate
+		}
+		return hlsDefaultVideoBandwidth
+	}
+	sort.Slice(videoRenditions, func(i, j int) bool {
+		return bandwidth(videoRenditions[i]) < bandwidth(videoRenditions[j])
+	})
+
+	audio, hasAudio := p.renditions[hlsAudioRendition]
+	hasAudio = hasAudio && audio.isReady()
+
+	playlist := &strings.Builder{}
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if hasAudio {
+		fmt.Fprintf(playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"audio\",DEFAULT=YES,AUTOSELECT=YES,CHANNELS=\"%d\",URI=\"%s/index.m3u8\"\n", recordingAudioChannels, hlsAudioRendition)
+	}
+
+	for _, r := range videoRenditions {
+		codecs, audioGroup, bandwidth := r.codecs, "", bandwidth(r)
+		if hasAudio {
+			codecs, audioGroup, bandwidth = codecs+",opus", ",AUDIO=\"audio\"", bandwidth+hlsAudioBandwidth
+		}
+
+		fmt.Fprintf(playlist, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\",RESOLUTION=%dx%d%s\n%s/index.m3u8\n", bandwidth, codecs, r.width, r.height, audioGroup, r.name)
+	}
+
+	return []byte(playlist.String()), "application/vnd.apple.mpegurl", nil
+}
+
+func (p *hlsPackager) renditionFile(ctx context.Context, renditionName, fileName string, msn, part int64) ([]byte, string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	r, ok := p.renditions[renditionName]
+	if !ok {
+		return nil, "", ErrHLSNotFound
+	}
+
+	contentType := "video/mp4"
+	if r.layer == "" {
+		contentType = "audio/mp4"
+	}
+
+	if fileName == "index.m3u8" {
+		return r.mediaPlaylist(ctx, p, msn, part)
+	} else if numbers, ok := hlsFileNumbers(fileName, "init-", 1); ok {
+		if init, ok := r.initSegments[int(numbers[0])]; ok {
+			return init, contentType, nil
+		}
+	} else if numbers, ok := hlsFileNumbers(fileName, "segment-", 1); ok {
+		if segment := r.segment(numbers[0]); segment != nil && segment != r.current {
+			return segment.data(), contentType, nil
+		}
+	} else if numbers, ok := hlsFileNumbers(fileName, "part-", 2); ok {
+		// The part of the preload hint is sent once it is ready
+		if err := p.wait(ctx, func() bool { return !r.isNextPart(numbers[0], numbers[1]) }); err != nil {
+			return nil, "", err
+		}
+
+		if segment := r.segment(numbers[0]); segment != nil && numbers[1] < uint64(len(segment.parts)) {
+			return segment.parts[numbers[1]].data, contentType, nil
+		}
+	}
+
+	return nil, "", ErrHLSNotFound
+}
+
+// hlsFileNumbers parses the dot separated numbers of a media file name like
+// part-3.1.mp4
+func hlsFileNumbers(fileName, prefix string, count int) ([]uint64, bool) {
+	if !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, ".mp4") {
+		return nil, false
+	}
+
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(fileName, prefix), ".mp4"), ".")
+	if len(fields) != count {
+		return nil, false
+	}
+
+	numbers := make([]uint64, count)
+	for i := range fields {
+		number, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = number
+	}
+
+	return numbers, true
+}
+
+// segment returns a kept or the current segment by its media sequence number
+func (r *hlsRendition) segment(msn uint64) *hlsSegment {
+	if r.current != nil && r.current.msn == msn {
+		return r.current
+	}
+
+	for _, segment := range r.segments {
+		if segment.msn == msn {
+			return segment
+		}
+	}
+
+	return nil
+}
+
+// isNextPart reports if msn and part are what the packager will create next
+func (r *hlsRendition) isNextPart(msn, part uint64) bool {
+	if r.current != nil {
+		return msn == r.current.msn && part == uint64(len(r.current.parts))
+	}
+
+	return msn == r.nextMSN && part == 0
+}
+
+func (s *hlsSegment) data() []byte {
+	data := []byte{}
+	for _, part := range s.parts {
+		data = append(data, part.data...)
+	}
+
+	return data
+}
+
+// mediaPlaylist returns the playlist of the rendition. If msn is set it is
+// held until that segment, or part of it, is ready.
+func (r *hlsRendition) mediaPlaylist(ctx context.Context, p *hlsPackager, msn, part int64) ([]byte, string, error) {
+	if msn >= 0 {
+		if uint64(msn) > r.nextMSN+2 {
+			return nil, "", ErrHLSBlockingRequestInvalid
+		}
+
+		err := p.wait(ctx, func() bool {
+			if part < 0 || r.current == nil || uint64(msn) != r.current.msn {
+				return uint64(msn) < r.nextMSN
+			}
+
+			return part < int64(len(r.current.parts))
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	} else if err := p.wait(ctx, r.isReady); err != nil {
+		return nil, "", err
+	}
+
+	segments := append([]*hlsSegment{}, r.segments...)
+	if r.current != nil {
+		segments = append(segments, r.current)
+	}
+
+	targetDuration := hlsTargetDuration
+	for _, segment := range segments {
+		if segment.duration > targetDuration {
+			targetDuration = segment.duration
+		}
+	}
+
+	playlist := &strings.Builder{}
+	fmt.Fprintf(playlist, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds())))
+	fmt.Fprintf(playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", (3 * hlsPartTarget).Seconds())
+	fmt.Fprintf(playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", hlsPartTarget.Seconds())
+	fmt.Fprintf(playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].msn)
+
+	initNumber := -1
+	for i, segment := range segments {
+		if segment.discontinuity && i != 0 {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		if segment.initNumber != initNumber {
+			initNumber = segment.initNumber
+			fmt.Fprintf(playlist, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", initNumber)
+		}
+
+		if i >= len(segments)-hlsSegmentsListingParts {
+			for j, part := range segment.parts {
+				independent := ""
+				if part.independent {
+					independent = ",INDEPENDENT=YES"
+				}
+				fmt.Fprintf(playlist, "#EXT-X-PART:DURATION=%.3f,URI=\"part-%d.%d.mp4\"%s\n", part.duration.Seconds(), segment.msn, j, independent)
+			}
+		}
+
+		if segment != r.current {
+			fmt.Fprintf(playlist, "#EXTINF:%.3f,\nsegment-%d.mp4\n", segment.duration.Seconds(), segment.msn)
+		}
+	}
+
+	nextMSN, nextPart := r.nextMSN, 0
+	if r.current != nil {
+		nextMSN, nextPart = r.current.msn, len(r.current.parts)
+	}
+	fmt.Fprintf(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%d.%d.mp4\"\n", nextMSN, nextPart)
+
+	return []byte(playlist.String()), "application/vnd.apple.mpegurl", nil
+}
+
+// HLSBlockingQuery parses the _HLS_msn and _HLS_part query parameters of a
+// blocking playlist reload, either is -1 if unset
+func HLSBlockingQuery(msnValue, partValue string) (msn, part int64, err error) {
+	parse := func(value string) (int64, error) {
+		if value == "" {
+			return -1, nil
+		}
+
+		number, err := strconv.ParseUint(value, 10, 63)
+		if err != nil {
+			return 0, ErrHLSQueryInvalid
+		}
+		return int64(number), nil
+	}
+
+	if msn, err = parse(msnValue); err != nil {
+		return 0, 0, err
+	} else if part, err = parse(partValue); err != nil {
+		return 0, 0, err
+	} else if part >= 0 && msn < 0 {
+		return 0, 0, ErrHLSQueryInvalid
+	}
+
+	return msn, part, nil
+}
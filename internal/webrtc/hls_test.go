@@ -0,0 +1,213 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// opusFrameTicks is the duration of an Opus packet of 20ms at 48kHz
+const opusFrameTicks = 960
+
+func TestHLSBlockingQuery(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		msnValue, partValue string
+		msn, part           int64
+		err                 error
+	}{
+		{name: "unset", msn: -1, part: -1},
+		{name: "msn", msnValue: "5", msn: 5, part: -1},
+		{name: "msn and part", msnValue: "5", partValue: "2", msn: 5, part: 2},
+		{name: "zero", msnValue: "0", partValue: "0", msn: 0, part: 0},
+		{name: "part without msn", partValue: "2", err: ErrHLSQueryInvalid},
+		{name: "negative msn", msnValue: "-1", err: ErrHLSQueryInvalid},
+		{name: "negative part", msnValue: "5", partValue: "-1", err: ErrHLSQueryInvalid},
+		{name: "not a number", msnValue: "five", err: ErrHLSQueryInvalid},
+		{name: "too large", msnValue: "9223372036854775808", err: ErrHLSQueryInvalid},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			msn, part, err := HLSBlockingQuery(test.msnValue, test.partValue)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			} else if err == nil && (msn != test.msn || part != test.part) {
+				t.Fatalf("expected %d/%d, got %d/%d", test.msn, test.part, msn, part)
+			}
+		})
+	}
+}
+
+func TestHLSFileNumbers(t *testing.T) {
+	for _, test := range []struct {
+		fileName, prefix string
+		count            int
+		numbers          []uint64
+		ok               bool
+	}{
+		{fileName: "part-3.1.mp4", prefix: "part-", count: 2, numbers: []uint64{3, 1}, ok: true},
+		{fileName: "segment-12.mp4", prefix: "segment-", count: 1, numbers: []uint64{12}, ok: true},
+		{fileName: "part-3.mp4", prefix: "part-", count: 2},
+		{fileName: "part-3.1.2.mp4", prefix: "part-", count: 2},
+		{fileName: "part--3.1.mp4", prefix: "part-", count: 2},
+		{fileName: "part-3.1.m4s", prefix: "part-", count: 2},
+		{fileName: "segment-12.mp4", prefix: "part-", count: 1},
+	} {
+		numbers, ok := hlsFileNumbers(test.fileName, test.prefix, test.count)
+		if ok != test.ok || (ok && (len(numbers) != len(test.numbers) || numbers[0] != test.numbers[0])) {
+			t.Errorf("hlsFileNumbers(%q) = %v, %t, expected %v, %t", test.fileName, numbers, ok, test.numbers, test.ok)
+		}
+	}
+}
+
+// packageHLSOpus sends count Opus packets of 20ms to the packager of s
+func packageHLSOpus(s *stream, first, count int) {
+	for i := first; i < first+count; i++ {
+		s.packageHLSAudio(&rtp.Packet{Header: rtp.Header{Timestamp: uint32(i * opusFrameTicks)}, Payload: []byte{0xFC, byte(i)}})
+	}
+}
+
+func TestHLSAudioRendition(t *testing.T) {
+	p := newHLSPackager()
+	s := &stream{}
+	s.hlsPackager.Store(p)
+
+	// A part is cut every 500ms, a segment after 2s. The 101st packet ends
+	// the first segment, the next 30 fill a part of the second one and 5
+	// packets of the next part.
+	packageHLSOpus(s, 0, 131)
+
+	get := func(ctx context.Context, fileName string, msn, part int64) ([]byte, error) {
+		body, _, err := p.renditionFile(ctx, hlsAudioRendition, fileName, msn, part)
+		return body, err
+	}
+
+	playlist, err := get(context.Background(), "index.m3u8", -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500\n" +
+		"#EXT-X-PART-INF:PART-TARGET=0.500\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-MAP:URI=\"init-0.mp4\"\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-0.0.mp4\",INDEPENDENT=YES\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-0.1.mp4\",INDEPENDENT=YES\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-0.2.mp4\",INDEPENDENT=YES\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-0.3.mp4\",INDEPENDENT=YES\n" +
+		"#EXTINF:2.000,\nsegment-0.mp4\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"part-1.0.mp4\",INDEPENDENT=YES\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-1.1.mp4\"\n"
+	if string(playlist) != expected {
+		t.Fatalf("expected playlist\n%s\ngot\n%s", expected, playlist)
+	}
+
+	// A segment is its parts one after another
+	segment, err := get(context.Background(), "segment-0.mp4", -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []byte{}
+	for i := 0; i < 4; i++ {
+		part, err := get(context.Background(), fmt.Sprintf("part-0.%d.mp4", i), -1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part...)
+	}
+	if !bytes.Equal(segment, parts) {
+		t.Fatal("segment differs from its parts")
+	}
+
+	for _, fileName := range []string{"init-0.mp4", "part-1.0.mp4"} {
+		if _, err := get(context.Background(), fileName, -1, -1); err != nil {
+			t.Fatalf("%s: %v", fileName, err)
+		}
+	}
+
+	// The current segment isn't complete yet, the rest never existed
+	for _, fileName := range []string{"segment-1.mp4", "init-1.mp4", "part-0.4.mp4", "part-9.0.mp4", "index.mp4"} {
+		if _, err := get(context.Background(), fileName, -1, -1); !errors.Is(err, ErrHLSNotFound) {
+			t.Fatalf("%s: expected %v, got %v", fileName, ErrHLSNotFound, err)
+		}
+	}
+}
+
+func TestHLSBlockingPlaylistReload(t *testing.T) {
+	p := newHLSPackager()
+	s := &stream{}
+	s.hlsPackager.Store(p)
+	packageHLSOpus(s, 0, 131)
+
+	get := func(timeout time.Duration, fileName string, msn, part int64) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		body, _, err := p.renditionFile(ctx, hlsAudioRendition, fileName, msn, part)
+		return body, err
+	}
+
+	for _, test := range []struct {
+		name      string
+		msn, part int64
+		err       error
+	}{
+		{name: "complete segment", msn: 0, part: -1},
+		{name: "part of complete segment", msn: 0, part: 3},
+		{name: "part of current segment", msn: 1, part: 0},
+		{name: "next part", msn: 1, part: 1, err: ErrHLSTimeout},
+		{name: "current segment", msn: 1, part: -1, err: ErrHLSTimeout},
+		{name: "segment after the current one", msn: 3, part: -1, err: ErrHLSTimeout},
+		{name: "too far ahead", msn: 4, part: -1, err: ErrHLSBlockingRequestInvalid},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := get(50*time.Millisecond, "index.m3u8", test.msn, test.part); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	// Requests for the next part are held until it is cut
+	type result struct {
+		body []byte
+		err  error
+	}
+	playlist, part := make(chan result, 1), make(chan result, 1)
+	go func() {
+		body, err := get(5*time.Second, "index.m3u8", 1, 1)
+		playlist <- result{body, err}
+	}()
+	go func() {
+		body, err := get(5*time.Second, "part-1.1.mp4", -1, -1)
+		part <- result{body, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	packageHLSOpus(s, 131, 21)
+
+	if r := <-playlist; r.err != nil {
+		t.Fatal(r.err)
+	} else if !strings.Contains(string(r.body), "URI=\"part-1.1.mp4\"") || !strings.Contains(string(r.body), "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-1.2.mp4\"") {
+		t.Fatalf("playlist doesn't list the part it was held for\n%s", r.body)
+	}
+
+	if r := <-part; r.err != nil || len(r.body) == 0 {
+		t.Fatalf("part wasn't sent once it was cut: %v", r.err)
+	}
+
+	// Closing the packager ends held requests
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.close()
+	}()
+	if _, err := get(5*time.Second, "index.m3u8", 2, -1); !errors.Is(err, ErrHLSNotFound) {
+		t.Fatalf("expected %v, got %v", ErrHLSNotFound, err)
+	}
+}
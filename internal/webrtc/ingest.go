@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	ingestMTU = 1200
+
+	ingestVideoClockRate = 90000
+	ingestAudioClockRate = 48000
+)
+
+// Ingest publishes media that doesn't arrive over WebRTC, like the H264 and
+// Opus of a RTMP encoder. It is packetized into RTP and takes the same path as
+// the media of a WHIP publisher, so viewers can't tell the difference.
+type Ingest struct {
+	stream     *stream
+	playbackID string
+	session    *whipSession
+
+	videoTrack          *whipVideoTrack
+	h264Payloader       codecs.H264Payloader
+	videoSSRC           uint32
+	videoSequenceNumber uint16
+
+	audio               *audioForwarder
+	audioSSRC           uint32
+	audioSequenceNumber uint16
+}
+
+// StartIngest makes an encoder the publisher of streamKey, following
+// PUBLISHER_CONFLICT_POLICY like WHIP does. disconnect is called when the
+// publisher is replaced or the stream ends.
+func StartIngest(streamKey string, private bool, disconnect func()) (*Ingest, error) {
+	playbackID := PlaybackID(streamKey)
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+	stream, err := getStream(playbackID)
+	if err != nil {
+		return nil, err
+	}
+
+	activeSession, err := stream.admitPublisher()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &whipSession{
+		id:               uuid.New().String(),
+		startedAt:        time.Now(),
+		negotiatedCodecs: []videoCodec{videoCodecH264},
+		disconnect:       disconnect,
+	}
+	session.connected.Store(true)
+
+	stream.addPublisher(session, activeSession, private)
+
+	return &Ingest{
+		stream:              stream,
+		playbackID:          playbackID,
+		session:             session,
+		videoSSRC:           rand.Uint32(),
+		videoSequenceNumber: uint16(rand.Uint32()),
+		audio:               &audioForwarder{},
+		audioSSRC:           rand.Uint32(),
+		audioSequenceNumber: uint16(rand.Uint32()),
+	}, nil
+}
+
+// WriteH264 sends the NAL units of a frame, keyframes have to carry their SPS
+// and PPS. Frames come in decode order and are timed by their decode time, RTP
+// timestamps must not go backwards with B-frames.
+func (i *Ingest) WriteH264(nalus [][]byte, dts time.Duration) error {
+	// The track starts with the first keyframe, its fmtp line is taken from the
+	// SPS of which the second to fourth byte are the profile-level-id
+	for _, nalu := range nalus {
+		if i.videoTrack != nil {
+			break
+		} else if nalu[0]&0x1F == h264NALUTypeSPS && len(nalu) >= 4 {
+			i.videoTrack = &whipVideoTrack{
+				layer:     videoTrackLabelDefault,
+				codec:     videoCodecH264,
+				fmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + hex.EncodeToString(nalu[1:4]),
+				clockRate: ingestVideoClockRate,
+			}
+			i.stream.addTrack(i.session, i.videoTrack)
+		}
+	}
+
+	if i.videoTrack == nil {
+		return nil
+	}
+
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		payloads = append(payloads, i.h264Payloader.Payload(ingestMTU, nalu)...)
+	}
+
+	timestamp := uint32(dts.Seconds() * ingestVideoClockRate)
+	for j, payload := range payloads {
+		rtpPkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         j == len(payloads)-1,
+				SequenceNumber: i.videoSequenceNumber,
+				Timestamp:      timestamp,
+				SSRC:           i.videoSSRC,
+			},
+			Payload: payload,
+		}
+		i.videoSequenceNumber++
+
+		i.videoTrack.updateBitrate(rtpPkt.MarshalSize())
+		if i.stream.whipSession.Load() == i.session {
+			i.stream.writeVideo(i.session, i.videoTrack, rtpPkt)
+		}
+	}
+
+	return nil
+}
+
+// WriteOpus sends an Opus packet
+func (i *Ingest) WriteOpus(packet []byte, pts time.Duration) error {
+	if i.stream.whipSession.Load() != i.session {
+		i.audio.forwarding = false
+		return nil
+	}
+
+	rtpPkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			SequenceNumber: i.audioSequenceNumber,
+			Timestamp:      uint32(pts.Seconds() * ingestAudioClockRate),
+			SSRC:           i.audioSSRC,
+		},
+		Payload: packet,
+	}
+	i.audioSequenceNumber++
+
+	return i.stream.writeAudio(i.audio, rtpPkt, ingestAudioClockRate)
+}
+
+// Close ends the publish. Like a WHIP publisher that lost its connection the
+// stream waits PUBLISHER_RECONNECT_GRACE_PERIOD for the encoder to come back.
+func (i *Ingest) Close() {
+	err := disconnectWHIPSession(i.playbackID, i.session.id)
+	if err != nil && !errors.Is(err, errStreamNotFound) && !errors.Is(err, errWHIPSessionNotFound) {
+		log.Println(err)
+	}
+}
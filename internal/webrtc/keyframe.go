@@ -0,0 +1,203 @@
+package webrtc
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+
+	// IRAP pictures are NAL unit types 16 (BLA_W_LP) to 21 (CRA_NUT)
+	h265NALUTypeIRAPFirst = 16
+	h265NALUTypeIRAPLast  = 21
+	h265NALUTypeVPS       = 32
+	h265NALUTypeSPS       = 33
+	h265NALUTypeAP        = 48
+	h265NALUTypeFU        = 49
+
+	av1OBUTypeSequenceHeader = 1
+)
+
+// isKeyframe reports if the RTP payload starts a keyframe, which is where a
+// viewer can begin decoding after a layer switch
+func isKeyframe(payload []byte, codec videoCodec) bool {
+	switch codec {
+	case videoCodecH264:
+		return isH264Keyframe(payload)
+	case videoCodecH265:
+		return isH265Keyframe(payload)
+	case videoCodecAV1:
+		return isAV1Keyframe(payload)
+	case videoCodecVP8:
+		return isVP8Keyframe(payload)
+	case videoCodecVP9, videoCodecVP9Profile2:
+		return isVP9Keyframe(payload)
+	}
+
+	return false
+}
+
+// isH264Keyframe looks for an IDR slice or a SPS, which precedes it, in
+// single NAL unit, STAP-A and the first FU-A packet
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1F; naluType {
+	case h264NALUTypeIDR, h264NALUTypeSPS:
+		return true
+	case h264NALUTypeSTAPA:
+		for offset := 1; offset+2 < len(payload); {
+			naluSize := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+
+			if aggregatedType := payload[offset] & 0x1F; aggregatedType == h264NALUTypeIDR || aggregatedType == h264NALUTypeSPS {
+				return true
+			}
+
+			offset += naluSize
+		}
+	case h264NALUTypeFUA:
+		if len(payload) < 2 {
+			return false
+		}
+
+		isStart := payload[1]&0x80 != 0
+		fragmentType := payload[1] & 0x1F
+		return isStart && (fragmentType == h264NALUTypeIDR || fragmentType == h264NALUTypeSPS)
+	}
+
+	return false
+}
+
+// isH265Keyframe looks for an IRAP picture or the VPS/SPS preceding it in
+// single NAL unit, aggregation and the first fragmentation unit packet. DONL
+// fields aren't expected, they are only sent if sprop-max-don-diff is negotiated.
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	isKeyframeType := func(naluType byte) bool {
+		return (naluType >= h265NALUTypeIRAPFirst && naluType <= h265NALUTypeIRAPLast) ||
+			naluType == h265NALUTypeVPS || naluType == h265NALUTypeSPS
+	}
+
+	switch naluType := (payload[0] >> 1) & 0x3F; naluType {
+	case h265NALUTypeAP:
+		for offset := 2; offset+2 < len(payload); {
+			naluSize := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+
+			if isKeyframeType((payload[offset] >> 1) & 0x3F) {
+				return true
+			}
+
+			offset += naluSize
+		}
+	case h265NALUTypeFU:
+		if len(payload) < 3 {
+			return false
+		}
+
+		isStart := payload[2]&0x80 != 0
+		return isStart && isKeyframeType(payload[2]&0x3F)
+	default:
+		return isKeyframeType(naluType)
+	}
+
+	return false
+}
+
+// isAV1Keyframe checks the N bit of the aggregation header, which is set on the
+// first packet of a coded video sequence, or for a leading sequence header OBU
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	aggregationHeader := payload[0]
+	if aggregationHeader&0x08 != 0 {
+		return true
+	}
+
+	// Z bit set means the first OBU continues a fragment from the previous packet
+	if aggregationHeader&0x80 != 0 {
+		return false
+	}
+
+	// Unless W says the packet holds a single OBU, the first one is prefixed with a LEB128 length
+	obuHeaderOffset := 1
+	if aggregationHeader&0x30 != 0x10 {
+		for obuHeaderOffset < len(payload) && payload[obuHeaderOffset]&0x80 != 0 {
+			obuHeaderOffset++
+		}
+		obuHeaderOffset++
+	}
+
+	return obuHeaderOffset < len(payload) && (payload[obuHeaderOffset]>>3)&0x0F == av1OBUTypeSequenceHeader
+}
+
+// isVP8Keyframe skips the payload descriptor of the first packet of a partition
+// and checks the inverse key frame flag of the frame header
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 || payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+
+		extension := payload[1]
+		offset++
+
+		// PictureID is one or two bytes, depending on its M bit
+		if extension&0x80 != 0 {
+			if offset < len(payload) && payload[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		// TL0PICIDX
+		if extension&0x40 != 0 {
+			offset++
+		}
+		// TID/Y/KEYIDX
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+
+	return offset < len(payload) && payload[offset]&0x01 == 0
+}
+
+// isVP9Keyframe looks for the start of a frame that isn't inter-picture
+// predicted in the lowest spatial layer
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	descriptor := payload[0]
+	if descriptor&0x40 != 0 || descriptor&0x08 == 0 {
+		return false
+	}
+
+	// Without layer indices there is a single spatial layer
+	if descriptor&0x20 == 0 {
+		return true
+	}
+
+	offset := 1
+	if descriptor&0x80 != 0 {
+		if offset < len(payload) && payload[offset]&0x80 != 0 {
+			offset++
+		}
+		offset++
+	}
+
+	return offset < len(payload) && (payload[offset]>>1)&0x07 == 0
+}
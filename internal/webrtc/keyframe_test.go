@@ -0,0 +1,65 @@
+package webrtc
+
+import "testing"
+
+func TestIsKeyframe(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		codec    videoCodec
+		payload  []byte
+		keyframe bool
+	}{
+		{name: "H264 IDR", codec: videoCodecH264, payload: []byte{0x65, 0x88}, keyframe: true},
+		{name: "H264 SPS", codec: videoCodecH264, payload: []byte{0x67, 0x42}, keyframe: true},
+		{name: "H264 non-IDR slice", codec: videoCodecH264, payload: []byte{0x41, 0x9A}},
+		{name: "H264 STAP-A with SPS", codec: videoCodecH264, payload: []byte{0x78, 0, 2, 0x67, 0x42, 0, 2, 0x68, 0xCE}, keyframe: true},
+		{name: "H264 STAP-A with IDR after SEI", codec: videoCodecH264, payload: []byte{0x78, 0, 2, 0x06, 0x05, 0, 2, 0x65, 0x88}, keyframe: true},
+		{name: "H264 STAP-A without keyframe", codec: videoCodecH264, payload: []byte{0x78, 0, 2, 0x06, 0x05, 0, 2, 0x41, 0x9A}},
+		{name: "H264 STAP-A with size past the end", codec: videoCodecH264, payload: []byte{0x78, 0xFF, 0xFF, 0x06}},
+		{name: "H264 FU-A start of IDR", codec: videoCodecH264, payload: []byte{0x7C, 0x85, 0x88}, keyframe: true},
+		{name: "H264 FU-A middle of IDR", codec: videoCodecH264, payload: []byte{0x7C, 0x05, 0x88}},
+		{name: "H264 FU-A start of non-IDR slice", codec: videoCodecH264, payload: []byte{0x7C, 0x81, 0x9A}},
+		{name: "H264 truncated FU-A", codec: videoCodecH264, payload: []byte{0x7C}},
+		{name: "H264 empty", codec: videoCodecH264, payload: []byte{}},
+
+		{name: "H265 IDR", codec: videoCodecH265, payload: []byte{19 << 1, 1}, keyframe: true},
+		{name: "H265 CRA", codec: videoCodecH265, payload: []byte{21 << 1, 1}, keyframe: true},
+		{name: "H265 VPS", codec: videoCodecH265, payload: []byte{32 << 1, 1}, keyframe: true},
+		{name: "H265 trailing picture", codec: videoCodecH265, payload: []byte{1 << 1, 1}},
+		{name: "H265 AP with VPS", codec: videoCodecH265, payload: []byte{48 << 1, 1, 0, 2, 32 << 1, 1}, keyframe: true},
+		{name: "H265 AP without keyframe", codec: videoCodecH265, payload: []byte{48 << 1, 1, 0, 2, 39 << 1, 1, 0, 2, 1 << 1, 1}},
+		{name: "H265 FU start of IDR", codec: videoCodecH265, payload: []byte{49 << 1, 1, 0x80 | 19}, keyframe: true},
+		{name: "H265 FU middle of IDR", codec: videoCodecH265, payload: []byte{49 << 1, 1, 19}},
+		{name: "H265 truncated FU", codec: videoCodecH265, payload: []byte{49 << 1, 1}},
+
+		{name: "AV1 new coded video sequence", codec: videoCodecAV1, payload: []byte{0x18, 0x32}, keyframe: true},
+		{name: "AV1 single sequence header OBU", codec: videoCodecAV1, payload: []byte{0x10, 0x08, 0}, keyframe: true},
+		{name: "AV1 sequence header OBU with length", codec: videoCodecAV1, payload: []byte{0x20, 0x02, 0x08, 0, 0x01, 0x32}, keyframe: true},
+		{name: "AV1 sequence header OBU with two byte length", codec: videoCodecAV1, payload: []byte{0x00, 0x81, 0x01, 0x08, 0}, keyframe: true},
+		{name: "AV1 frame OBU", codec: videoCodecAV1, payload: []byte{0x10, 0x32, 0}},
+		{name: "AV1 continued fragment", codec: videoCodecAV1, payload: []byte{0x90, 0x08, 0}},
+		{name: "AV1 truncated length", codec: videoCodecAV1, payload: []byte{0x20, 0x82}},
+
+		{name: "VP8 keyframe", codec: videoCodecVP8, payload: []byte{0x10, 0x50}, keyframe: true},
+		{name: "VP8 interframe", codec: videoCodecVP8, payload: []byte{0x10, 0x51}},
+		{name: "VP8 keyframe with 15 bit PictureID", codec: videoCodecVP8, payload: []byte{0x90, 0x80, 0x81, 0x23, 0x50}, keyframe: true},
+		{name: "VP8 keyframe with 7 bit PictureID, TL0PICIDX and KEYIDX", codec: videoCodecVP8, payload: []byte{0x90, 0xF0, 0x12, 0x03, 0x20, 0x50}, keyframe: true},
+		{name: "VP8 interframe with 7 bit PictureID", codec: videoCodecVP8, payload: []byte{0x90, 0x80, 0x12, 0x51}},
+		{name: "VP8 continued partition", codec: videoCodecVP8, payload: []byte{0x00, 0x50}},
+		{name: "VP8 second partition", codec: videoCodecVP8, payload: []byte{0x11, 0x50}},
+		{name: "VP8 truncated descriptor", codec: videoCodecVP8, payload: []byte{0x90, 0x80, 0x81}},
+
+		{name: "VP9 keyframe", codec: videoCodecVP9, payload: []byte{0x08, 0x82}, keyframe: true},
+		{name: "VP9 inter-picture predicted", codec: videoCodecVP9, payload: []byte{0x48, 0x82}},
+		{name: "VP9 keyframe in the lowest spatial layer", codec: videoCodecVP9, payload: []byte{0xA8, 0x80, 0x01, 0x00}, keyframe: true},
+		{name: "VP9 keyframe in a higher spatial layer", codec: videoCodecVP9, payload: []byte{0xA8, 0x80, 0x01, 0x02}},
+
+		{name: "unknown codec", codec: videoCodec(""), payload: []byte{0x65}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if keyframe := isKeyframe(test.payload, test.codec); keyframe != test.keyframe {
+				t.Fatalf("expected %t, got %t", test.keyframe, keyframe)
+			}
+		})
+	}
+}
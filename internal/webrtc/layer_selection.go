@@ -0,0 +1,228 @@
+package webrtc
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// layerAuto unpins a WHEP session so its layer follows the estimated bandwidth
+	layerAuto = "auto"
+
+	layerSelectionInterval = time.Second
+	bitrateMeasureInterval = time.Second
+
+	initialBandwidthEstimate = 1_000_000
+
+	// A layer is only upgraded if the link showed no loss or queuing delay for
+	// the upgrade delay. It is doubled every time an upgrade had to be undone.
+	layerUpgradeMaxLoss      = 0.02
+	layerUpgradeDelay        = 5 * time.Second
+	layerUpgradeDelayMax     = 60 * time.Second
+	layerDowngradeMinLoss    = 0.1
+	layerUpgradeProbeTimeout = 3 * time.Second
+)
+
+type layerBitrate struct {
+	layer   string
+	bitrate uint64
+}
+
+var (
+	// The cc interceptor hands out the estimator while the PeerConnection is
+	// created, newWHEPPeerConnection picks it up from here.
+	bandwidthEstimatorLock sync.Mutex
+	bandwidthEstimators    = make(chan cc.BandwidthEstimator, 1)
+)
+
+func onNewBandwidthEstimator(_ string, estimator cc.BandwidthEstimator) {
+	select {
+	case bandwidthEstimators <- estimator:
+	default:
+	}
+}
+
+// newWHEPPeerConnection returns a PeerConnection answering offer and the
+// estimator of its outgoing bandwidth
+func newWHEPPeerConnection(offer string) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	api, err := newAPI(false, offer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bandwidthEstimatorLock.Lock()
+	defer bandwidthEstimatorLock.Unlock()
+
+	select {
+	case <-bandwidthEstimators:
+	default:
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case estimator := <-bandwidthEstimators:
+		return peerConnection, estimator, nil
+	default:
+		return peerConnection, nil, nil
+	}
+}
+
+// updateBitrate accounts a packet of the track, called by its videoWriter only
+func (t *whipVideoTrack) updateBitrate(bytes int) {
+	now := time.Now()
+	if t.bitrateStartAt.IsZero() {
+		t.bitrateStartAt = now
+	}
+
+	t.bitrateBytes += bytes
+	if elapsed := now.Sub(t.bitrateStartAt); elapsed >= bitrateMeasureInterval {
+		t.bitrate.Store(uint64(float64(t.bitrateBytes*8) / elapsed.Seconds()))
+		t.bitrateBytes = 0
+		t.bitrateStartAt = now
+	}
+}
+
+// layerBitrates returns the layers of the active publisher that are sending in
+// one of codecs, ordered from lowest to highest bitrate
+func (s *stream) layerBitrates(codecs map[videoCodec]bool) (layers []layerBitrate) {
+	w := s.whipSession.Load()
+	if w == nil {
+		return nil
+	}
+
+	w.videoTracksLock.RLock()
+	for _, t := range w.videoTracks {
+		if bitrate := t.bitrate.Load(); bitrate != 0 && codecs[t.codec] {
+			layers = append(layers, layerBitrate{layer: t.layer, bitrate: bitrate})
+		}
+	}
+	w.videoTracksLock.RUnlock()
+
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].bitrate < layers[j].bitrate
+	})
+	return
+}
+
+// requestLayer switches the viewer to layer once it sends a keyframe
+func (w *whepSession) requestLayer(s *stream, layer string) {
+	w.packetLock.Lock()
+	w.pendingLayer = layer
+	if layer == w.currentLayer.Load() {
+		w.pendingLayer = ""
+	}
+	w.packetLock.Unlock()
+
+	s.sendPLI(layer)
+}
+
+// estimatedBitrate is the target bitrate of the congestion controller, capped
+// by the REMB of the viewer if it sends one
+func (w *whepSession) estimatedBitrate() uint64 {
+	bitrate := uint64(initialBandwidthEstimate)
+	if w.bandwidthEstimator != nil {
+		bitrate = uint64(w.bandwidthEstimator.GetTargetBitrate())
+	}
+
+	if remb := w.rembBitrate.Load(); remb != 0 && remb < bitrate {
+		bitrate = remb
+	}
+
+	return bitrate
+}
+
+// congested reports the loss and if the delay based estimator sees queuing
+func (w *whepSession) congested() (averageLoss float64, overuse bool) {
+	if w.bandwidthEstimator == nil {
+		return 0, false
+	}
+
+	stats := w.bandwidthEstimator.GetStats()
+	averageLoss, _ = stats["averageLoss"].(float64)
+	usage, _ := stats["usage"].(string)
+	state, _ := stats["state"].(string)
+	return averageLoss, usage == "overuse" || state == "decrease"
+}
+
+// selectLayers moves the viewer between the layers of the stream until the
+// session is closed. The current layer is kept while the estimate is ramping
+// up, it is only dropped when the link is congested. Upgrades go one layer at a
+// time once the estimate covers the bitrate of the higher layer, and are undone
+// if it causes congestion.
+func (w *whepSession) selectLayers(s *stream) {
+	ticker := time.NewTicker(layerSelectionInterval)
+	defer ticker.Stop()
+
+	upgradeDelay := layerUpgradeDelay
+	uncongestedSince := time.Now()
+	var upgradedAt time.Time
+
+	for range ticker.C {
+		if w.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		w.packetLock.Lock()
+		currentLayer, _ := w.currentLayer.Load().(string)
+		skip := w.layerPinned || w.pendingLayer != "" || currentLayer == ""
+		w.packetLock.Unlock()
+
+		layers := s.layerBitrates(w.videoCodecs)
+		if skip || len(layers) < 2 {
+			continue
+		}
+
+		current := -1
+		for i := range layers {
+			if layers[i].layer == currentLayer {
+				current = i
+			}
+		}
+		if current == -1 {
+			continue
+		}
+
+		estimate := w.estimatedBitrate()
+		averageLoss, overuse := w.congested()
+		remb := w.rembBitrate.Load()
+
+		switch {
+		case current > 0 && (averageLoss >= layerDowngradeMinLoss || (overuse && layers[current].bitrate > estimate) || (remb != 0 && layers[current].bitrate > remb)):
+			target := 0
+			for i := current - 1; i > 0; i-- {
+				if layers[i].bitrate <= estimate {
+					target = i
+					break
+				}
+			}
+
+			if !upgradedAt.IsZero() && time.Since(upgradedAt) < layerUpgradeProbeTimeout+layerSelectionInterval {
+				if upgradeDelay *= 2; upgradeDelay > layerUpgradeDelayMax {
+					upgradeDelay = layerUpgradeDelayMax
+				}
+			}
+
+			upgradedAt = time.Time{}
+			uncongestedSince = time.Now()
+			w.requestLayer(s, layers[target].layer)
+		case averageLoss >= layerUpgradeMaxLoss || overuse:
+			uncongestedSince = time.Now()
+		case current < len(layers)-1 && time.Since(uncongestedSince) >= upgradeDelay && layers[current+1].bitrate <= estimate:
+			upgradedAt = time.Now()
+			uncongestedSince = time.Now()
+			w.requestLayer(s, layers[current+1].layer)
+		case !upgradedAt.IsZero() && time.Since(upgradedAt) >= layerUpgradeDelayMax:
+			// The upgrade held, later ones don't have to wait as long
+			upgradedAt = time.Time{}
+			upgradeDelay = layerUpgradeDelay
+		}
+	}
+}
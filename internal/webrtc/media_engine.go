@@ -0,0 +1,338 @@
+package webrtc
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	h264ProfileConstrainedBaseline = "constrained-baseline"
+	h264ProfileBaseline            = "baseline"
+	h264ProfileMain                = "main"
+	h264ProfileConstrainedHigh     = "constrained-high"
+	h264ProfileHigh                = "high"
+)
+
+type (
+	// videoCodecConfig is a codec Broadcast Box offers and accepts. H264 is
+	// configured by profile in h264Configs instead.
+	videoCodecConfig struct {
+		mimeType    string
+		sdpFmtpLine string
+	}
+
+	// h264Config is a H264 profile that is accepted at any level. The
+	// profile-level-id is only used in offers Broadcast Box creates itself.
+	h264Config struct {
+		profileLevelID     string
+		packetizationModes []string
+	}
+)
+
+var (
+	videoCodecConfigs = []videoCodecConfig{
+		{mimeType: webrtc.MimeTypeAV1},
+		{mimeType: webrtc.MimeTypeVP8},
+		{mimeType: webrtc.MimeTypeVP9, sdpFmtpLine: "profile-id=0"},
+		{mimeType: webrtc.MimeTypeVP9, sdpFmtpLine: "profile-id=2"},
+		{mimeType: webrtc.MimeTypeH265},
+	}
+
+	h264Configs = []h264Config{
+		{profileLevelID: "42e01f", packetizationModes: []string{"1", "0"}},
+		{profileLevelID: "42001f", packetizationModes: []string{"1", "0"}},
+		{profileLevelID: "4d001f", packetizationModes: []string{"1"}},
+		{profileLevelID: "640c1f", packetizationModes: []string{"1"}},
+		{profileLevelID: "640032", packetizationModes: []string{"1"}},
+	}
+
+	videoRTCPFeedback = []webrtc.RTCPFeedback{
+		{Type: "goog-remb"},
+		{Type: "ccm", Parameter: "fir"},
+		{Type: webrtc.TypeRTCPFBNACK},
+		{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+		{Type: webrtc.TypeRTCPFBTransportCC},
+	}
+
+	opusPayloadType = webrtc.PayloadType(111)
+)
+
+// h264Profile names the profile of a profile-level-id following RFC 6184, the
+// level is left out as sender and receiver may use different ones
+func h264Profile(profileLevelID string) string {
+	b, err := hex.DecodeString(profileLevelID)
+	if err != nil || len(b) != 3 {
+		return ""
+	}
+
+	profileIDC, profileIOP := b[0], b[1]
+	constraintSet0, constraintSet1 := profileIOP&0x80 != 0, profileIOP&0x40 != 0
+	constraintSet4, constraintSet5 := profileIOP&0x08 != 0, profileIOP&0x04 != 0
+
+	switch {
+	case profileIDC == 0x42 && constraintSet1,
+		profileIDC == 0x4D && constraintSet0,
+		profileIDC == 0x58 && constraintSet0 && constraintSet1:
+		return h264ProfileConstrainedBaseline
+	case profileIDC == 0x42, profileIDC == 0x58 && constraintSet0:
+		return h264ProfileBaseline
+	case profileIDC == 0x4D:
+		return h264ProfileMain
+	case profileIDC == 0x64 && constraintSet4 && constraintSet5:
+		return h264ProfileConstrainedHigh
+	case profileIDC == 0x64:
+		return h264ProfileHigh
+	}
+
+	return ""
+}
+
+// h264Format is the profile and packetization-mode of a H264 fmtp line, which
+// have to be the same on both sides. packetization-mode defaults to 0.
+func h264Format(fmtpLine string) string {
+	packetizationMode := fmtpParameter(fmtpLine, "packetization-mode")
+	if packetizationMode == "" {
+		packetizationMode = "0"
+	}
+
+	return h264Profile(fmtpParameter(fmtpLine, "profile-level-id")) + "/" + packetizationMode
+}
+
+// h264Accepted reports if a H264 fmtp line uses one of the configured profiles
+func h264Accepted(fmtpLine string) bool {
+	format := h264Format(fmtpLine)
+	for _, config := range h264Configs {
+		for _, packetizationMode := range config.packetizationModes {
+			if format == h264Profile(config.profileLevelID)+"/"+packetizationMode {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// newMediaEngine creates the MediaEngine for a PeerConnection. Video codecs
+// of a remote offer are registered as they were offered if they match the
+// configuration, so any level and fmtp of a configured H264 profile is accepted
+// and answered unchanged. Without an offer the configuration is registered.
+func newMediaEngine(offer string) (*webrtc.MediaEngine, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: opusPayloadType,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	codecs := configuredVideoCodecs()
+	if offer != "" {
+		codecs = offeredVideoCodecs(offer)
+	}
+
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, extension := range []string{
+		sdp.SDESMidURI,
+		sdp.SDESRTPStreamIDURI,
+		"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		sdp.TransportCCURI,
+	} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// videoCodecAccepted reports if an offered codec matches the configuration
+func videoCodecAccepted(codec webrtc.RTPCodecCapability) bool {
+	if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+		return h264Accepted(codec.SDPFmtpLine)
+	}
+
+	for _, config := range videoCodecConfigs {
+		if strings.EqualFold(codec.MimeType, config.mimeType) &&
+			videoCodecFromParameters(webrtc.RTPCodecParameters{RTPCodecCapability: codec}) == videoCodecFromParameters(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: config.mimeType, SDPFmtpLine: config.sdpFmtpLine}}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configuredVideoCodecs returns the configured codecs with a RTX codec each
+func configuredVideoCodecs() (codecs []webrtc.RTPCodecParameters) {
+	payloadType := webrtc.PayloadType(95)
+	nextPayloadType := func() webrtc.PayloadType {
+		if payloadType++; payloadType == opusPayloadType {
+			payloadType++
+		}
+		return payloadType
+	}
+
+	add := func(mimeType, sdpFmtpLine string) {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     mimeType,
+				ClockRate:    90000,
+				SDPFmtpLine:  sdpFmtpLine,
+				RTCPFeedback: videoRTCPFeedback,
+			},
+			PayloadType: nextPayloadType(),
+		}
+
+		codecs = append(codecs, codec, webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    "video/rtx",
+				ClockRate:   90000,
+				SDPFmtpLine: "apt=" + strconv.Itoa(int(codec.PayloadType)),
+			},
+			PayloadType: nextPayloadType(),
+		})
+	}
+
+	for _, config := range h264Configs {
+		for _, packetizationMode := range config.packetizationModes {
+			add(webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode="+packetizationMode+";profile-level-id="+config.profileLevelID)
+		}
+	}
+
+	for _, config := range videoCodecConfigs {
+		add(config.mimeType, config.sdpFmtpLine)
+	}
+
+	return
+}
+
+// offeredVideoCodecs returns the codecs of the first video section of offer
+// that match the configuration, and their RTX codecs
+func offeredVideoCodecs(offer string) (codecs []webrtc.RTPCodecParameters) {
+	rtpmaps, fmtps := offeredRTPMaps(offer)
+
+	accepted := map[string]bool{}
+	for _, payloadType := range sortedPayloadTypes(rtpmaps) {
+		mimeType, clockRate, _ := strings.Cut(rtpmaps[payloadType], "/")
+		codec := webrtc.RTPCodecCapability{
+			MimeType:     "video/" + mimeType,
+			ClockRate:    90000,
+			SDPFmtpLine:  fmtps[payloadType],
+			RTCPFeedback: videoRTCPFeedback,
+		}
+
+		if clockRate != "90000" || !videoCodecAccepted(codec) {
+			continue
+		}
+
+		accepted[payloadType] = true
+		codecs = append(codecs, webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: payloadTypeFromString(payloadType)})
+	}
+
+	for _, payloadType := range sortedPayloadTypes(rtpmaps) {
+		if strings.EqualFold(rtpmaps[payloadType], "rtx/90000") && accepted[fmtpParameter(fmtps[payloadType], "apt")] {
+			codecs = append(codecs, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:    "video/rtx",
+					ClockRate:   90000,
+					SDPFmtpLine: fmtps[payloadType],
+				},
+				PayloadType: payloadTypeFromString(payloadType),
+			})
+		}
+	}
+
+	return
+}
+
+// sortedPayloadTypes orders payload types numerically, which keeps registration deterministic
+func sortedPayloadTypes(rtpmaps map[string]string) []string {
+	payloadTypes := make([]string, 0, len(rtpmaps))
+	for payloadType := range rtpmaps {
+		payloadTypes = append(payloadTypes, payloadType)
+	}
+
+	sort.Slice(payloadTypes, func(i, j int) bool {
+		return payloadTypeFromString(payloadTypes[i]) < payloadTypeFromString(payloadTypes[j])
+	})
+	return payloadTypes
+}
+
+func payloadTypeFromString(payloadType string) webrtc.PayloadType {
+	pt, _ := strconv.ParseUint(payloadType, 10, 8)
+	return webrtc.PayloadType(pt)
+}
+
+// offeredRTPMaps returns the rtpmap and fmtp of the first video section by payload type
+func offeredRTPMaps(offer string) (rtpmaps, fmtps map[string]string) {
+	rtpmaps, fmtps = map[string]string{}, map[string]string{}
+
+	inVideo := false
+	for _, line := range splitSDP(offer) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			if inVideo {
+				return
+			}
+			inVideo = strings.HasPrefix(line, "m=video ")
+		case !inVideo:
+			continue
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			if payloadType, rtpmap, ok := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " "); ok {
+				rtpmaps[payloadType] = rtpmap
+			}
+		case strings.HasPrefix(line, "a=fmtp:"):
+			if payloadType, fmtp, ok := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " "); ok {
+				fmtps[payloadType] = fmtp
+			}
+		}
+	}
+
+	return
+}
+
+// answerH264FmtpLine replaces the fmtp line of the viewer's H264 codec that
+// matches the profile of the publisher with the one of the publisher, so the
+// viewer learns the level and parameters of the video it is going to get
+func answerH264FmtpLine(answer, publisherFmtpLine string, viewerCodecs []webrtc.RTPCodecParameters) string {
+	if publisherFmtpLine == "" {
+		return answer
+	}
+
+	for _, codec := range viewerCodecs {
+		if videoCodecFromParameters(codec) != videoCodecH264 || h264Format(codec.SDPFmtpLine) != h264Format(publisherFmtpLine) {
+			continue
+		}
+
+		prefix := "a=fmtp:" + strconv.Itoa(int(codec.PayloadType)) + " "
+		lines := strings.Split(answer, "\r\n")
+		for i := range lines {
+			if strings.HasPrefix(lines[i], prefix) {
+				lines[i] = prefix + publisherFmtpLine
+				break
+			}
+		}
+
+		return strings.Join(lines, "\r\n")
+	}
+
+	return answer
+}
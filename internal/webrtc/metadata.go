@@ -0,0 +1,157 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// metadataMaxSize keeps the packet carrying the metadata below the MTU
+	metadataMaxSize = 1000
+
+	h264NALUTypeSEI            = 6
+	h265NALUTypePrefixSEI      = 39
+	seiPayloadTypeUnregistered = 5
+
+	av1OBUTypeMetadata = 5
+
+	// AV1 leaves metadata types 6 to 31 to unregistered user private data
+	av1MetadataTypeUserPrivate = 6
+
+	// The aggregation header of an AV1 RTP packet holding a single OBU
+	av1AggregationHeaderSingleOBU = 0x10
+)
+
+var (
+	// ErrMetadataTooLarge is returned for metadata that doesn't fit into a packet
+	ErrMetadataTooLarge = errors.New("metadata is too large")
+	// ErrMetadataNotSupported is returned when none of the video of a stream can carry metadata
+	ErrMetadataNotSupported = errors.New("metadata can only be sent with H264, H265 or AV1 video")
+
+	// metadataUUID identifies the user data unregistered SEI messages of
+	// Broadcast Box, the metadata follows it
+	metadataUUID = [16]byte{0x6d, 0x1c, 0x4e, 0x0b, 0x8a, 0x35, 0x4f, 0x2e, 0x9d, 0x63, 0x13, 0x0c, 0x5a, 0x7e, 0x42, 0xb1}
+)
+
+// SendMetadata inserts data into the video of the live stream playbackID, so
+// players receive it with the frame that follows. It is sent as a user data
+// unregistered SEI message with H264 and H265 and as a metadata OBU of the
+// first unregistered user private type with AV1. Recordings and HLS keep it.
+func SendMetadata(playbackID string, data []byte) error {
+	if len(data) > metadataMaxSize {
+		return ErrMetadataTooLarge
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	s, ok := streamMap[playbackID]
+	if !ok || !s.isActive() {
+		return ErrStreamNotLive
+	}
+
+	w := s.whipSession.Load()
+	w.videoTracksLock.RLock()
+	defer w.videoTracksLock.RUnlock()
+
+	queued := false
+	for _, t := range w.videoTracks {
+		if t.codec == videoCodecH264 || t.codec == videoCodecH265 || t.codec == videoCodecAV1 {
+			t.metadataLock.Lock()
+			t.metadata = append(t.metadata, data)
+			t.metadataLock.Unlock()
+			queued = true
+		}
+	}
+
+	if !queued {
+		return ErrMetadataNotSupported
+	}
+
+	return nil
+}
+
+// withMetadata puts packets carrying the queued metadata in front of the first
+// packet of a frame. Keyframes are skipped, their parameter sets have to come
+// first. The inserted packets shift the sequence numbers of the track, which
+// is what the rest of the stream sees. Only called by the writer of the track.
+func (t *whipVideoTrack) withMetadata(rtpPkt *rtp.Packet) []*rtp.Packet {
+	frameStart := !t.metadataStarted || rtpPkt.Timestamp != t.metadataLastTimestamp
+	t.metadataStarted, t.metadataLastTimestamp = true, rtpPkt.Timestamp
+
+	var metadata [][]byte
+	if frameStart && !isKeyframe(rtpPkt.Payload, t.codec) {
+		t.metadataLock.Lock()
+		metadata, t.metadata = t.metadata, nil
+		t.metadataLock.Unlock()
+	}
+
+	packets := make([]*rtp.Packet, 0, len(metadata)+1)
+	for _, data := range metadata {
+		packets = append(packets, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    rtpPkt.PayloadType,
+				SequenceNumber: rtpPkt.SequenceNumber + t.sequenceNumberOffset,
+				Timestamp:      rtpPkt.Timestamp,
+				SSRC:           rtpPkt.SSRC,
+			},
+			Payload: metadataPayload(t.codec, data),
+		})
+		t.sequenceNumberOffset++
+	}
+
+	rtpPkt.SequenceNumber += t.sequenceNumberOffset
+	return append(packets, rtpPkt)
+}
+
+// metadataPayload is a RTP payload holding nothing but data
+func metadataPayload(codec videoCodec, data []byte) []byte {
+	if codec == videoCodecAV1 {
+		obu := []byte{av1AggregationHeaderSingleOBU, av1OBUTypeMetadata << 3}
+		obu = binary.AppendUvarint(obu, av1MetadataTypeUserPrivate)
+		obu = append(obu, data...)
+		return append(obu, 0x80)
+	}
+
+	// The size of SEI messages is coded in bytes of 255 and a remainder
+	sei := []byte{seiPayloadTypeUnregistered}
+	size := len(metadataUUID) + len(data)
+	for ; size >= 0xFF; size -= 0xFF {
+		sei = append(sei, 0xFF)
+	}
+	sei = append(sei, byte(size))
+	sei = append(sei, metadataUUID[:]...)
+	sei = append(sei, data...)
+	sei = append(sei, 0x80)
+
+	nalu := []byte{h264NALUTypeSEI}
+	if codec == videoCodecH265 {
+		nalu = []byte{h265NALUTypePrefixSEI << 1, 1}
+	}
+
+	return appendEmulationPrevention(nalu, sei)
+}
+
+// appendEmulationPrevention escapes the start code prefixes in rbsp, a 0x03
+// follows every two zero bytes that precede a byte below 0x04
+func appendEmulationPrevention(nalu, rbsp []byte) []byte {
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			nalu = append(nalu, 0x03)
+			zeros = 0
+		}
+
+		nalu = append(nalu, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return nalu
+}
@@ -0,0 +1,273 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	originRequestTimeout = 10 * time.Second
+
+	// PrivateStreamHeader tells an edge if the stream it pulled is private
+	PrivateStreamHeader = "X-Stream-Private"
+)
+
+// ErrOriginUnavailable is returned when a stream can't be pulled from ORIGIN_WHEP_URL
+var ErrOriginUnavailable = errors.New("stream could not be pulled from the origin")
+
+var (
+	// originWHEPURL is the WHEP endpoint of the origin edges pull their streams from
+	originWHEPURL string
+
+	// edgeToken is the credential edges pull streams from the origin with
+	edgeToken string
+
+	originHTTPClient = &http.Client{Timeout: originRequestTimeout}
+)
+
+func configureOrigin() {
+	edgeToken = os.Getenv("EDGE_TOKEN")
+	if originWHEPURL = os.Getenv("ORIGIN_WHEP_URL"); originWHEPURL == "" {
+		return
+	}
+
+	if _, err := url.Parse(originWHEPURL); err != nil {
+		log.Fatal(err)
+	} else if edgeToken == "" {
+		log.Fatal("EDGE_TOKEN must be set to pull streams from ORIGIN_WHEP_URL")
+	}
+}
+
+// IsEdgeToken reports if token is EDGE_TOKEN, edges are disabled when it isn't set
+func IsEdgeToken(token string) bool {
+	return edgeToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(edgeToken)) == 1
+}
+
+// pullFromOrigin makes the stream of the origin the publisher of playbackID if
+// it has none. The edge authenticates with EDGE_TOKEN, viewers are checked by
+// the edge itself. Every viewer shares the same upstream.
+func pullFromOrigin(playbackID string) (*stream, error) {
+	streamMapLock.Lock()
+	stream, err := getStream(playbackID)
+	if err != nil {
+		streamMapLock.Unlock()
+		return nil, err
+	}
+
+	// A publisher that lost its connection may still come back
+	if stream.whipSession.Load() != nil || stream.reconnectTimer != nil {
+		streamMapLock.Unlock()
+		return stream, nil
+	}
+
+	api, err := newAPI(true, "")
+	if err != nil {
+		streamMapLock.Unlock()
+		return nil, err
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		streamMapLock.Unlock()
+		return nil, err
+	}
+
+	// The session on the origin is deleted once the stream is dropped
+	var resourceURL atomic.Pointer[string]
+	session := &whipSession{
+		id:             uuid.New().String(),
+		peerConnection: peerConnection,
+		startedAt:      time.Now(),
+		pulled:         true,
+		disconnect: func() {
+			if err := peerConnection.Close(); err != nil {
+				log.Println(err)
+			}
+
+			if u := resourceURL.Load(); u != nil {
+				go deleteOriginSession(*u)
+			}
+		},
+	}
+
+	// The session is added before the origin answers, so viewers arriving in
+	// the meantime don't pull the stream again
+	stream.addPublisher(session, nil, false)
+	streamMapLock.Unlock()
+
+	private, err := session.pull(stream, playbackID, &resourceURL)
+	if err != nil {
+		if deleteErr := deleteWHIPSession(playbackID, session.id); deleteErr != nil && !errors.Is(deleteErr, errStreamNotFound) && !errors.Is(deleteErr, errWHIPSessionNotFound) {
+			log.Println(deleteErr)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrOriginUnavailable, err)
+	}
+
+	streamMapLock.Lock()
+	if stream.whipSession.Load() == session && private {
+		stream.private = true
+		stream.deleteUnauthorizedWHEPSessions()
+	}
+	streamMapLock.Unlock()
+
+	return stream, nil
+}
+
+// pull negotiates with the origin and returns if the stream is private there,
+// the media it sends takes the same path as the media of a WHIP publisher
+func (w *whipSession) pull(s *stream, playbackID string, resourceURL *atomic.Pointer[string]) (bool, error) {
+	w.peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
+		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
+			audioWriter(remoteTrack, s, w)
+		} else {
+			videoWriter(remoteTrack, s, w)
+		}
+	})
+
+	w.peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
+		switch i {
+		case webrtc.ICEConnectionStateConnected:
+			if !w.connected.Swap(true) && s.whipSession.Load() == w {
+				s.sendEvent(s.activeEvent())
+			}
+		case webrtc.ICEConnectionStateFailed:
+			// Viewers are closed and pull the stream again when they reconnect
+			if err := deleteWHIPSession(playbackID, w.id); err != nil && !errors.Is(err, errStreamNotFound) && !errors.Is(err, errWHIPSessionNotFound) {
+				log.Println(err)
+			}
+		}
+	})
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := w.peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return false, err
+		}
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(w.peerConnection)
+	offer, err := w.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return false, err
+	} else if err = w.peerConnection.SetLocalDescription(offer); err != nil {
+		return false, err
+	}
+	<-gatherComplete
+
+	base, err := url.Parse(originWHEPURL)
+	if err != nil {
+		return false, err
+	}
+
+	// The origin takes the Playback ID from the query, the bearer token is EDGE_TOKEN
+	pullURL := *base
+	query := pullURL.Query()
+	query.Set("playbackId", playbackID)
+	pullURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, pullURL.String(), bytes.NewBufferString(w.peerConnection.LocalDescription().SDP))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	req.Header.Set("Authorization", "Bearer "+edgeToken)
+
+	resp, err := originHTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	} else if resp.StatusCode != http.StatusCreated {
+		return false, fmt.Errorf("origin responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(answer))
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return false, err
+	}
+	resolvedURL := base.ResolveReference(location).String()
+	resourceURL.Store(&resolvedURL)
+
+	if err = w.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  string(answer),
+		Type: webrtc.SDPTypeAnswer,
+	}); err != nil {
+		return false, err
+	}
+
+	// Viewers may already be comparing codecs with the session
+	negotiatedCodecs := []videoCodec{}
+	for _, transceiver := range w.peerConnection.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			for _, codec := range transceiver.Receiver().GetParameters().Codecs {
+				if c := videoCodecFromParameters(codec); c != "" {
+					negotiatedCodecs = append(negotiatedCodecs, c)
+				}
+			}
+		}
+	}
+
+	w.videoTracksLock.Lock()
+	w.negotiatedCodecs = negotiatedCodecs
+	w.videoTracksLock.Unlock()
+
+	return resp.Header.Get(PrivateStreamHeader) == "true", nil
+}
+
+func deleteOriginSession(resourceURL string) {
+	req, err := http.NewRequest(http.MethodDelete, resourceURL, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+edgeToken)
+
+	resp, err := originHTTPClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// dropUnwatchedPull ends a stream pulled from the origin once its last viewer left
+func (s *stream) dropUnwatchedPull() {
+	streamMapLock.Lock()
+
+	active := s.whipSession.Load()
+	if active == nil || !active.pulled || len(s.whipStandby) != 0 {
+		streamMapLock.Unlock()
+		return
+	}
+
+	s.whepSessionsLock.RLock()
+	viewerCount := len(s.whepSessions)
+	s.whepSessionsLock.RUnlock()
+
+	playbackID, _ := findWHIPSession(active.id)
+	if viewerCount != 0 || streamMap[playbackID] != s {
+		streamMapLock.Unlock()
+		return
+	}
+
+	delete(streamMap, playbackID)
+	streamMapLock.Unlock()
+
+	s.close()
+}
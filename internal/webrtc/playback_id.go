@@ -0,0 +1,39 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"os"
+)
+
+const playbackIDLength = 12
+
+var playbackIDSecret []byte
+
+// Streams are stored and watched by their playback ID. It is derived from the
+// stream key with a HMAC so viewers can't learn the key they would need to
+// publish.
+func configurePlaybackIDs() {
+	if secret := os.Getenv("PLAYBACK_ID_SECRET"); secret != "" {
+		playbackIDSecret = []byte(secret)
+		return
+	}
+
+	playbackIDSecret = make([]byte, sha256.Size)
+	if _, err := rand.Read(playbackIDSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("PLAYBACK_ID_SECRET is not set, playback IDs will change when the server restarts")
+}
+
+// PlaybackID returns the public ID viewers use to watch what is published with streamKey
+func PlaybackID(streamKey string) string {
+	mac := hmac.New(sha256.New, playbackIDSecret)
+	mac.Write([]byte(streamKey))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:playbackIDLength])
+}
@@ -0,0 +1,126 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	playbackTokenHeader struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+	}
+
+	playbackTokenClaims struct {
+		Stream    string `json:"stream"`
+		ExpiresAt int64  `json:"exp"`
+		Viewer    string `json:"viewer,omitempty"`
+	}
+)
+
+var (
+	// ErrPlaybackTokenRequired is returned when a private stream is watched without a token
+	ErrPlaybackTokenRequired = errors.New("stream is private, a playback token is required")
+	// ErrPlaybackTokenInvalid is returned for tokens that are malformed, forged or expired
+	ErrPlaybackTokenInvalid = errors.New("playback token is invalid")
+
+	playbackTokenSecret []byte
+)
+
+// Playback tokens are HS256 JWTs, so they can also be minted by other services
+// that know PLAYBACK_TOKEN_SECRET. An origin and its edges check each other's
+// tokens, so they can't run with a random secret.
+func configurePlaybackTokens() {
+	if secret := os.Getenv("PLAYBACK_TOKEN_SECRET"); secret != "" {
+		playbackTokenSecret = []byte(secret)
+		return
+	}
+
+	if os.Getenv("ORIGIN_WHEP_URL") != "" || os.Getenv("EDGE_TOKEN") != "" {
+		log.Fatal("PLAYBACK_TOKEN_SECRET must be set on an origin and its edges")
+	}
+
+	playbackTokenSecret = make([]byte, sha256.Size)
+	if _, err := rand.Read(playbackTokenSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("PLAYBACK_TOKEN_SECRET is not set, playback tokens will stop working when the server restarts")
+}
+
+// MintPlaybackToken returns a token that allows watching playbackID until expiresAt
+func MintPlaybackToken(playbackID, viewerID string, expiresAt time.Time) (string, error) {
+	header, err := json.Marshal(playbackTokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(playbackTokenClaims{
+		Stream:    playbackID,
+		ExpiresAt: expiresAt.Unix(),
+		Viewer:    viewerID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + signPlaybackToken(unsigned), nil
+}
+
+// playbackIDFromBearerToken returns the stream a viewer wants to watch, the
+// claims are nil if it sent a playback ID instead of a token
+func playbackIDFromBearerToken(bearerToken string) (string, *playbackTokenClaims, error) {
+	if !isPlaybackToken(bearerToken) {
+		return bearerToken, nil, nil
+	}
+
+	claims, err := parsePlaybackToken(bearerToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return claims.Stream, claims, nil
+}
+
+func isPlaybackToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+func parsePlaybackToken(token string) (*playbackTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(signPlaybackToken(parts[0]+"."+parts[1]))) {
+		return nil, ErrPlaybackTokenInvalid
+	}
+
+	header, claims := &playbackTokenHeader{}, &playbackTokenClaims{}
+	for i, v := range []any{header, claims} {
+		decoded, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, ErrPlaybackTokenInvalid
+		} else if err = json.Unmarshal(decoded, v); err != nil {
+			return nil, ErrPlaybackTokenInvalid
+		}
+	}
+
+	if header.Alg != "HS256" || claims.Stream == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrPlaybackTokenInvalid
+	}
+
+	return claims, nil
+}
+
+func signPlaybackToken(unsigned string) string {
+	mac := hmac.New(sha256.New, playbackTokenSecret)
+	mac.Write([]byte(unsigned))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,570 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/fmp4"
+	"github.com/pion/rtp"
+)
+
+const (
+	recordingVideoTrackID  = 1
+	recordingAudioTrackID  = 2
+	recordingAudioChannels = 2
+
+	recordingFragmentDuration       = time.Second
+	recordingWriteQueueLength       = 16
+	recordingRetentionCheckInterval = time.Hour
+	defaultRecordingFileMaxDuration = time.Hour
+
+	// Duration of the last sample of a file, which has no successor to measure it by
+	recordingLastVideoSampleDuration = fmp4.VideoTimeScale / 30
+	recordingLastAudioSampleDuration = fmp4.OpusTimeScale / 50
+)
+
+var (
+	// ErrRecordingNotConfigured is returned when recording is started without a RECORDING_DIRECTORY
+	ErrRecordingNotConfigured = errors.New("recording is disabled, RECORDING_DIRECTORY is not set")
+
+	errRecordingWriterBehind = errors.New("recording can't keep up with the disk")
+)
+
+var (
+	recordingDirectory       string
+	recordingFileMaxDuration = defaultRecordingFileMaxDuration
+	recordingFileMaxSize     int64
+	recordingRetention       time.Duration
+
+	// recordedPlaybackIDs are the streams that are recorded whenever they are
+	// live, guarded by streamMapLock
+	recordedPlaybackIDs = map[string]bool{}
+)
+
+type (
+	// recorder writes a stream to fragmented MP4 files. Every publisher starts
+	// a new file, which begins with a keyframe of the recorded layer. Files are
+	// rotated at a keyframe once they reach the configured duration or size.
+	// The files are written by a goroutine of their own, so a slow disk never
+	// holds up the packets of the stream.
+	recorder struct {
+		directory string
+		writes    chan recordingWrite
+
+		lock   sync.Mutex
+		closed bool
+
+		// layer is the video layer that is recorded, it is picked by the first
+		// packet after the publisher changed
+		layer          string
+		videoAssembler *frameAssembler
+		needKeyframe   bool
+
+		file *recordingFile
+	}
+
+	recordingFile struct {
+		path      string
+		size      int64
+		startedAt time.Time
+
+		// failed is set by the writer when the file couldn't be written
+		failed atomic.Bool
+
+		// parameterSets the video track was configured with, a keyframe with
+		// different ones starts a new file
+		parameterSets string
+
+		sequenceNumber uint32
+		video, audio   *recordingTrack
+	}
+
+	// recordingTrack buffers the samples of a track until the next fragment.
+	// The last sample is pending until the next one tells its duration.
+	recordingTrack struct {
+		track *fmp4.Track
+
+		started       bool
+		lastTimestamp uint32
+		decodeTime    uint64
+
+		fragmentDecodeTime uint64
+		samples            []fmp4.Sample
+		pending            *fmp4.Sample
+	}
+
+	// recordingWrite is handed to the writer of a recorder. The first write of
+	// a file creates it, the last one closes it.
+	recordingWrite struct {
+		file          *recordingFile
+		data          []byte
+		create, close bool
+	}
+)
+
+func configureRecording() {
+	if recordingDirectory = os.Getenv("RECORDING_DIRECTORY"); recordingDirectory == "" {
+		return
+	}
+
+	var err error
+	if os.Getenv("RECORDING_FILE_MAX_DURATION") != "" {
+		if recordingFileMaxDuration, err = time.ParseDuration(os.Getenv("RECORDING_FILE_MAX_DURATION")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if os.Getenv("RECORDING_FILE_MAX_MEGABYTES") != "" {
+		megabytes, err := strconv.ParseInt(os.Getenv("RECORDING_FILE_MAX_MEGABYTES"), 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recordingFileMaxSize = megabytes * 1000 * 1000
+	}
+
+	if os.Getenv("RECORDING_RETENTION") != "" {
+		if recordingRetention, err = time.ParseDuration(os.Getenv("RECORDING_RETENTION")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err = os.MkdirAll(recordingDirectory, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
+	if recordingRetention != 0 {
+		go deleteExpiredRecordings()
+	}
+}
+
+// StartRecording records what is published with streamKey, right away if it
+// is live and otherwise once it goes live
+func StartRecording(streamKey string) error {
+	if recordingDirectory == "" {
+		return ErrRecordingNotConfigured
+	}
+
+	playbackID := PlaybackID(streamKey)
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	recordedPlaybackIDs[playbackID] = true
+	if s, ok := streamMap[playbackID]; ok && s.recorder.Load() == nil {
+		s.startRecording(playbackID)
+	}
+
+	return nil
+}
+
+// StopRecording stops recording what is published with streamKey and closes
+// the current file
+func StopRecording(streamKey string) error {
+	if recordingDirectory == "" {
+		return ErrRecordingNotConfigured
+	}
+
+	playbackID := PlaybackID(streamKey)
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	delete(recordedPlaybackIDs, playbackID)
+	if s, ok := streamMap[playbackID]; ok {
+		if r := s.recorder.Swap(nil); r != nil {
+			r.close()
+		}
+	}
+
+	return nil
+}
+
+// startRecording must be called with streamMapLock held
+func (s *stream) startRecording(playbackID string) {
+	s.recorder.Store(newRecorder(filepath.Join(recordingDirectory, playbackID)))
+	s.sendPLI("")
+}
+
+func newRecorder(directory string) *recorder {
+	r := &recorder{directory: directory, writes: make(chan recordingWrite, recordingWriteQueueLength)}
+	go r.writeFiles()
+
+	return r
+}
+
+// recordVideo passes a packet of a video layer to the recorder, returns true if
+// the layer should be asked for a keyframe
+func (s *stream) recordVideo(videoTrack *whipVideoTrack, rtpPkt *rtp.Packet) (requestKeyframe bool) {
+	r := s.recorder.Load()
+	if r == nil || (videoTrack.codec != videoCodecH264 && videoTrack.codec != videoCodecAV1) {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	if r.layer == "" {
+		// Record the layer with the highest bitrate if they are measured yet
+		r.layer = videoTrack.layer
+		if layers := s.layerBitrates(map[videoCodec]bool{videoCodecH264: true, videoCodecAV1: true}); len(layers) != 0 {
+			r.layer = layers[len(layers)-1].layer
+		}
+
+		r.videoAssembler = newFrameAssembler(s.layerCodecOrDefault(r.layer, videoTrack.codec))
+		r.needKeyframe = true
+	}
+
+	if videoTrack.layer != r.layer {
+		return false
+	}
+
+	frame, lost := r.videoAssembler.push(rtpPkt)
+	if lost {
+		r.needKeyframe = true
+	}
+
+	if frame == nil {
+		return lost
+	} else if r.needKeyframe && !frame.keyframe {
+		return true
+	}
+	r.needKeyframe = false
+
+	if frame.keyframe {
+		if err := r.rotate(); err != nil {
+			log.Println(err)
+			r.closeFile()
+			r.needKeyframe = true
+			return false
+		}
+	}
+
+	if r.file == nil {
+		return false
+	}
+
+	r.file.video.add(frame)
+	r.writeFragment(r.file.video)
+	return false
+}
+
+// recordAudio passes an Opus packet to the recorder, audio before the first
+// video keyframe of a file isn't recorded
+func (s *stream) recordAudio(rtpPkt *rtp.Packet) {
+	r := s.recorder.Load()
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed || r.file == nil {
+		return
+	}
+
+	audio := r.file.audio
+	if !audio.started {
+		audio.decodeTime = uint64(time.Since(r.file.startedAt).Seconds() * fmp4.OpusTimeScale)
+		audio.fragmentDecodeTime = audio.decodeTime
+	}
+
+	audio.add(&mediaFrame{data: append([]byte{}, rtpPkt.Payload...), timestamp: rtpPkt.Timestamp, keyframe: true})
+	r.writeFragment(audio)
+}
+
+// layerCodecOrDefault returns the codec of layer, or codec if it is gone
+func (s *stream) layerCodecOrDefault(layer string, codec videoCodec) videoCodec {
+	if layerCodec, ok := s.layerCodec(layer); ok {
+		return layerCodec
+	}
+
+	return codec
+}
+
+// publisherChanged starts a new file with the next publisher
+func (r *recorder) publisherChanged() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closeFile()
+	r.layer = ""
+}
+
+// trackRemoved ends the file if the recorded layer went away
+func (r *recorder) trackRemoved(layer string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if layer == r.layer {
+		r.closeFile()
+		r.layer = ""
+	}
+}
+
+func (r *recorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closeFile()
+	r.closed = true
+	close(r.writes)
+}
+
+// queueWrite hands write to the writer, it returns false instead of waiting
+// if the writer is too far behind
+func (r *recorder) queueWrite(write recordingWrite) bool {
+	select {
+	case r.writes <- write:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeFiles does the writes of the recorder until it is closed. A file that
+// fails to be written is closed and marked failed, its remaining writes are
+// ignored.
+func (r *recorder) writeFiles() {
+	var current *recordingFile
+	var file *os.File
+
+	closeCurrent := func() {
+		if file != nil {
+			if err := file.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		current, file = nil, nil
+	}
+	fail := func(err error) {
+		log.Println(err)
+		current.failed.Store(true)
+		closeCurrent()
+	}
+
+	for write := range r.writes {
+		if write.create {
+			// The previous file didn't get its last write if the writer fell behind
+			closeCurrent()
+			current = write.file
+
+			var err error
+			if err = os.MkdirAll(filepath.Dir(current.path), 0o755); err != nil {
+				fail(err)
+				continue
+			}
+			if file, err = os.Create(current.path); err != nil {
+				fail(err)
+				continue
+			}
+		} else if write.file != current {
+			continue
+		}
+
+		if _, err := file.Write(write.data); err != nil {
+			fail(err)
+			continue
+		}
+
+		if write.close {
+			closeCurrent()
+		}
+	}
+
+	closeCurrent()
+}
+
+// rotate starts a new file at a keyframe if there is none yet, the current
+// one is full or the video parameters changed
+func (r *recorder) rotate() error {
+	parameterSets := string(r.videoAssembler.sps) + string(r.videoAssembler.pps) + string(r.videoAssembler.sequenceHeader)
+
+	if f := r.file; f != nil {
+		full := time.Since(f.startedAt) >= recordingFileMaxDuration || (recordingFileMaxSize != 0 && f.size >= recordingFileMaxSize)
+		if !full && parameterSets == f.parameterSets {
+			return nil
+		}
+
+		r.closeFile()
+	}
+
+	var videoTrack *fmp4.Track
+	var err error
+	if r.videoAssembler.codec == videoCodecH264 {
+		videoTrack, err = fmp4.NewH264Track(recordingVideoTrackID, r.videoAssembler.sps, r.videoAssembler.pps)
+	} else {
+		videoTrack, err = fmp4.NewAV1Track(recordingVideoTrackID, r.videoAssembler.sequenceHeader)
+	}
+	if err != nil {
+		return err
+	}
+
+	startedAt := time.Now()
+	audioTrack := fmp4.NewOpusTrack(recordingAudioTrackID, recordingAudioChannels)
+	initSegment := fmp4.InitSegment(videoTrack, audioTrack)
+
+	file := &recordingFile{
+		path:          filepath.Join(r.directory, startedAt.UTC().Format("20060102T150405.000Z")+".mp4"),
+		size:          int64(len(initSegment)),
+		startedAt:     startedAt,
+		parameterSets: parameterSets,
+		video:         &recordingTrack{track: videoTrack},
+		audio:         &recordingTrack{track: audioTrack},
+	}
+	if !r.queueWrite(recordingWrite{file: file, data: initSegment, create: true}) {
+		return errRecordingWriterBehind
+	}
+
+	r.file = file
+	return nil
+}
+
+// add buffers a frame, frames that don't advance the timestamp are dropped
+func (t *recordingTrack) add(frame *mediaFrame) {
+	if t.started {
+		duration := frame.timestamp - t.lastTimestamp
+		if int32(duration) <= 0 {
+			return
+		}
+
+		t.pending.Duration = duration
+		t.samples = append(t.samples, *t.pending)
+		t.decodeTime += uint64(duration)
+	}
+
+	t.started = true
+	t.lastTimestamp = frame.timestamp
+	t.pending = &fmp4.Sample{Keyframe: frame.keyframe, Data: frame.data}
+}
+
+// bufferedDuration is the duration of the samples waiting for the next fragment
+func (t *recordingTrack) bufferedDuration() time.Duration {
+	return time.Duration(float64(t.decodeTime-t.fragmentDecodeTime) / float64(t.track.TimeScale) * float64(time.Second))
+}
+
+// writeFragment writes the buffered samples of all tracks once t buffered a
+// fragment worth of them. The file is given up if the writer failed it or
+// can't keep up, the next keyframe starts a new one.
+func (r *recorder) writeFragment(t *recordingTrack) {
+	if r.file.failed.Load() {
+		r.file = nil
+		r.needKeyframe = true
+		return
+	}
+
+	if t.bufferedDuration() < recordingFragmentDuration {
+		return
+	}
+
+	if fragment := r.file.fragment(); fragment != nil && !r.queueWrite(recordingWrite{file: r.file, data: fragment}) {
+		log.Printf("Closed recording %s: %s", r.file.path, errRecordingWriterBehind)
+		r.file = nil
+		r.needKeyframe = true
+	}
+}
+
+// fragment moves the buffered samples of all tracks into a fragment, it is
+// nil if there are none
+func (f *recordingFile) fragment() []byte {
+	fragments := []fmp4.TrackFragment{}
+	for _, t := range []*recordingTrack{f.video, f.audio} {
+		if len(t.samples) == 0 {
+			continue
+		}
+
+		fragments = append(fragments, fmp4.TrackFragment{Track: t.track, BaseDecodeTime: t.fragmentDecodeTime, Samples: t.samples})
+		t.fragmentDecodeTime = t.decodeTime
+		t.samples = nil
+	}
+
+	if len(fragments) == 0 {
+		return nil
+	}
+
+	f.sequenceNumber++
+	fragment := fmp4.Fragment(f.sequenceNumber, fragments...)
+	f.size += int64(len(fragment))
+
+	return fragment
+}
+
+// closeFile hands the pending samples to the writer and closes the current file
+func (r *recorder) closeFile() {
+	f := r.file
+	if f == nil {
+		return
+	}
+	r.file = nil
+
+	for _, t := range []*recordingTrack{f.video, f.audio} {
+		if t.pending == nil {
+			continue
+		}
+
+		t.pending.Duration = recordingLastAudioSampleDuration
+		if t.track.IsVideo() {
+			t.pending.Duration = recordingLastVideoSampleDuration
+		}
+
+		t.samples = append(t.samples, *t.pending)
+		t.decodeTime += uint64(t.pending.Duration)
+		t.pending = nil
+	}
+
+	// The writer closes the file with the next one if this doesn't fit
+	if !r.queueWrite(recordingWrite{file: f, data: f.fragment(), close: true}) {
+		log.Printf("Closed recording %s: %s", f.path, errRecordingWriterBehind)
+	}
+}
+
+// deleteExpiredRecordings deletes the files that are older than
+// RECORDING_RETENTION, and the directories of streams that have none left
+func deleteExpiredRecordings() {
+	for {
+		expiredBefore := time.Now().Add(-recordingRetention)
+
+		err := filepath.Walk(recordingDirectory, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && strings.HasSuffix(path, ".mp4") && info.ModTime().Before(expiredBefore) {
+				if err := os.Remove(path); err != nil {
+					log.Println(err)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		if entries, err := os.ReadDir(recordingDirectory); err == nil {
+			for _, entry := range entries {
+				if entry.IsDir() {
+					// Only succeeds if it is empty
+					_ = os.Remove(filepath.Join(recordingDirectory, entry.Name()))
+				}
+			}
+		}
+
+		time.Sleep(recordingRetentionCheckInterval)
+	}
+}
@@ -0,0 +1,80 @@
+package webrtc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glimesh/broadcast-box/internal/fmp4"
+)
+
+func TestRecorderWritesFiles(t *testing.T) {
+	r := &recorder{writes: make(chan recordingWrite, recordingWriteQueueLength)}
+	done := make(chan struct{})
+	go func() {
+		r.writeFiles()
+		close(done)
+	}()
+
+	directory := t.TempDir()
+	recorded := &recordingFile{path: filepath.Join(directory, "stream", "recorded.mp4")}
+	failed := &recordingFile{path: filepath.Join(directory, "missing", "\x00.mp4")}
+
+	r.writes <- recordingWrite{file: recorded, data: []byte("init"), create: true}
+	r.writes <- recordingWrite{file: recorded, data: []byte("fragment")}
+	r.writes <- recordingWrite{file: failed, data: []byte("init"), create: true}
+	r.writes <- recordingWrite{file: failed, data: []byte("fragment"), close: true}
+	// Writes to a file that was closed are ignored
+	r.writes <- recordingWrite{file: recorded, data: []byte("late")}
+	close(r.writes)
+	<-done
+
+	data, err := os.ReadFile(recorded.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("initfragment")) {
+		t.Fatalf("recorded %q, want %q", data, "initfragment")
+	}
+	if recorded.failed.Load() {
+		t.Fatal("recorded file is marked failed")
+	}
+	if !failed.failed.Load() {
+		t.Fatal("file that couldn't be created isn't marked failed")
+	}
+}
+
+func TestRecorderDropsFileWhenWriterIsBehind(t *testing.T) {
+	// Nothing reads the writes, like a writer that is stuck on the disk
+	r := &recorder{writes: make(chan recordingWrite)}
+	r.file = &recordingFile{
+		path:  "behind.mp4",
+		video: &recordingTrack{},
+		audio: &recordingTrack{track: fmp4.NewOpusTrack(recordingAudioTrackID, recordingAudioChannels)},
+	}
+
+	audio := r.file.audio
+	finished := make(chan struct{})
+	go func() {
+		for timestamp := uint32(0); timestamp <= 2*fmp4.OpusTimeScale; timestamp += fmp4.OpusTimeScale / 50 {
+			if r.file == nil {
+				break
+			}
+			audio.add(&mediaFrame{data: []byte{0}, timestamp: timestamp, keyframe: true})
+			r.writeFragment(audio)
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("recording blocked on the writer")
+	}
+
+	if r.file != nil || !r.needKeyframe {
+		t.Fatal("file wasn't dropped when the writer fell behind")
+	}
+}
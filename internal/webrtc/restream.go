@@ -0,0 +1,174 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrStreamNotLive is returned when a stream that has no publisher is restreamed
+var ErrStreamNotLive = errors.New("stream is not live")
+
+// Restream sends a live stream to a remote WHIP endpoint. It is a viewer whose
+// PeerConnection makes the offer, the remote endpoint answers it like it would
+// for a broadcaster.
+type Restream struct {
+	stream         *stream
+	playbackID     string
+	whepSessionId  string
+	session        *whepSession
+	videoRTPSender *webrtc.RTPSender
+
+	done     chan struct{}
+	doneOnce sync.Once
+	failed   atomic.Bool
+}
+
+// NewRestream creates the offer for restreaming what is published with
+// streamKey. layer is the simulcast layer that is sent, if empty the layer is
+// chosen by the estimated bandwidth like it is for viewers.
+func NewRestream(streamKey, layer string) (*Restream, string, error) {
+	playbackID := PlaybackID(streamKey)
+
+	streamMapLock.Lock()
+	stream, ok := streamMap[playbackID]
+	if !ok || !stream.isActive() {
+		streamMapLock.Unlock()
+		return nil, "", ErrStreamNotLive
+	}
+	publisherCodecs := stream.videoCodecs()
+	streamMapLock.Unlock()
+
+	peerConnection, bandwidthEstimator, err := newWHEPPeerConnection("")
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := &Restream{
+		stream:        stream,
+		playbackID:    playbackID,
+		whepSessionId: uuid.New().String(),
+		session: &whepSession{
+			peerConnection:     peerConnection,
+			bandwidthEstimator: bandwidthEstimator,
+			videoTrack:         &trackMultiCodec{id: "video", streamID: "pion"},
+			fixedLayer:         layer,
+			eventSubscribers:   map[chan WHEPEvent]struct{}{},
+			authorized:         true,
+		},
+		done: make(chan struct{}),
+	}
+	r.session.currentLayer.Store("")
+	r.session.resetLayer()
+
+	// The codec is bound when the answer arrives, the remote endpoint may
+	// accept any of the offered ones
+	if len(publisherCodecs) != 0 {
+		r.session.videoTrack.preferredCodec = publisherCodecs[0]
+	}
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			r.failed.Store(true)
+		}
+
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			r.doneOnce.Do(func() { close(r.done) })
+		}
+	})
+
+	if _, err = peerConnection.AddTransceiverFromTrack(stream.audioTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		r.Close()
+		return nil, "", err
+	}
+
+	videoTransceiver, err := peerConnection.AddTransceiverFromTrack(r.session.videoTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		r.Close()
+		return nil, "", err
+	}
+	r.videoRTPSender = videoTransceiver.Sender()
+
+	go r.session.readRTCP(stream, r.videoRTPSender)
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		r.Close()
+		return nil, "", err
+	} else if err = peerConnection.SetLocalDescription(offer); err != nil {
+		r.Close()
+		return nil, "", err
+	}
+	<-gatherComplete
+
+	return r, peerConnection.LocalDescription().SDP, nil
+}
+
+// SetAnswer applies the answer of the remote endpoint and starts forwarding
+// media
+func (r *Restream) SetAnswer(answer string) error {
+	if err := r.session.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  answer,
+		Type: webrtc.SDPTypeAnswer,
+	}); err != nil {
+		return err
+	}
+
+	r.session.videoCodecs = map[videoCodec]bool{}
+	for _, codec := range r.videoRTPSender.GetParameters().Codecs {
+		if c := videoCodecFromParameters(codec); c != "" {
+			r.session.videoCodecs[c] = true
+		}
+	}
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	// The broadcast may have ended while the remote endpoint was answering
+	if streamMap[r.playbackID] != r.stream {
+		return ErrStreamNotLive
+	}
+
+	if publisherCodecs := r.stream.videoCodecs(); len(publisherCodecs) != 0 {
+		if _, err := chooseVideoCodec(publisherCodecs, r.session.videoCodecs); err != nil {
+			return err
+		}
+	}
+
+	r.stream.whepSessionsLock.Lock()
+	r.stream.whepSessions[r.whepSessionId] = r.session
+	r.stream.whepSessionsLock.Unlock()
+
+	go r.session.selectLayers(r.stream)
+
+	r.stream.sendViewerCount()
+	r.stream.sendPLI(r.session.fixedLayer)
+	return nil
+}
+
+// Done is closed once the connection to the remote endpoint failed or the
+// broadcast ended
+func (r *Restream) Done() <-chan struct{} {
+	return r.done
+}
+
+// Failed reports if Done was closed because the connection failed
+func (r *Restream) Failed() bool {
+	return r.failed.Load()
+}
+
+// Close stops forwarding media and closes the connection
+func (r *Restream) Close() {
+	if r.stream.deleteWHEPSession(r.whepSessionId) {
+		return
+	}
+
+	if err := r.session.peerConnection.Close(); err != nil {
+		log.Println(err)
+	}
+}
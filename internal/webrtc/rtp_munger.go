@@ -0,0 +1,77 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// maxReorderedPackets is how late a packet of the current source may arrive
+const maxReorderedPackets = 0x4000
+
+// rtpMunger maps the sequence numbers and timestamps of the forwarded layer
+// onto the continuous ones a viewer sees. The offsets only change when the
+// source changes, so gaps stay visible for NACK and reordered packets keep
+// their place. All arithmetic wraps like the RTP fields do.
+type rtpMunger struct {
+	started  bool
+	rebasing bool
+
+	sequenceNumberOffset uint16
+	timestampOffset      uint32
+
+	// Oldest sequence number of the current source that is still forwarded
+	firstSequenceNumber uint16
+
+	// Highest values sent to the viewer and when they were sent
+	lastSequenceNumber uint16
+	lastTimestamp      uint32
+	lastSentAt         time.Time
+}
+
+// sequenceNumberNewer reports if a comes after b, taking wraparound into account
+func sequenceNumberNewer(a, b uint16) bool {
+	return a != b && a-b < 0x8000
+}
+
+// rebase makes the next packet continue the output of the previous source
+func (m *rtpMunger) rebase() {
+	m.rebasing = m.started
+}
+
+// munge rewrites rtpPkt in place. Packets from before the start of the current
+// source are dropped, as they would map onto sequence numbers already used.
+func (m *rtpMunger) munge(rtpPkt *rtp.Packet, clockRate uint32) (ok bool) {
+	switch {
+	case !m.started:
+		m.started = true
+		m.firstSequenceNumber = rtpPkt.SequenceNumber
+	case m.rebasing:
+		m.rebasing = false
+
+		// Advance by the time that passed since the last packet, at least by one tick
+		timestampAdvance := uint32(1)
+		if elapsed := elapsedRTPTime(m.lastSentAt, clockRate); elapsed > timestampAdvance {
+			timestampAdvance = elapsed
+		}
+
+		m.sequenceNumberOffset = m.lastSequenceNumber + 1 - rtpPkt.SequenceNumber
+		m.timestampOffset = m.lastTimestamp + timestampAdvance - rtpPkt.Timestamp
+		m.firstSequenceNumber = rtpPkt.SequenceNumber
+	case sequenceNumberNewer(m.firstSequenceNumber, rtpPkt.SequenceNumber):
+		return false
+	case rtpPkt.SequenceNumber-m.firstSequenceNumber > maxReorderedPackets:
+		// Keep trailing the source, the comparison above only works within half the range
+		m.firstSequenceNumber = rtpPkt.SequenceNumber - maxReorderedPackets
+	}
+
+	rtpPkt.SequenceNumber += m.sequenceNumberOffset
+	rtpPkt.Timestamp += m.timestampOffset
+
+	if !m.lastSentAt.IsZero() && !sequenceNumberNewer(rtpPkt.SequenceNumber, m.lastSequenceNumber) {
+		return true
+	}
+
+	m.lastSequenceNumber, m.lastTimestamp, m.lastSentAt = rtpPkt.SequenceNumber, rtpPkt.Timestamp, time.Now()
+	return true
+}
@@ -0,0 +1,138 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPMunger(t *testing.T) {
+	type step struct {
+		// rebase switches the source before the packet
+		rebase bool
+
+		sequenceNumber uint16
+		timestamp      uint32
+
+		dropped              bool
+		mungedSequenceNumber uint16
+		mungedTimestamp      uint32
+	}
+
+	for _, test := range []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first source is forwarded as is",
+			steps: []step{
+				{sequenceNumber: 100, timestamp: 3000, mungedSequenceNumber: 100, mungedTimestamp: 3000},
+				{sequenceNumber: 101, timestamp: 6000, mungedSequenceNumber: 101, mungedTimestamp: 6000},
+			},
+		},
+		{
+			name: "sequence numbers and timestamps wrap",
+			steps: []step{
+				{sequenceNumber: 65534, timestamp: 0xFFFFF000, mungedSequenceNumber: 65534, mungedTimestamp: 0xFFFFF000},
+				{sequenceNumber: 65535, timestamp: 0xFFFFFFFF, mungedSequenceNumber: 65535, mungedTimestamp: 0xFFFFFFFF},
+				{sequenceNumber: 0, timestamp: 0x00000FFF, mungedSequenceNumber: 0, mungedTimestamp: 0x00000FFF},
+				{sequenceNumber: 1, timestamp: 0x00001FFF, mungedSequenceNumber: 1, mungedTimestamp: 0x00001FFF},
+			},
+		},
+		{
+			name: "rebase continues the previous source",
+			steps: []step{
+				{sequenceNumber: 100, timestamp: 3000, mungedSequenceNumber: 100, mungedTimestamp: 3000},
+				{sequenceNumber: 101, timestamp: 6000, mungedSequenceNumber: 101, mungedTimestamp: 6000},
+				{rebase: true, sequenceNumber: 5000, timestamp: 900000, mungedSequenceNumber: 102, mungedTimestamp: 6001},
+				{sequenceNumber: 5001, timestamp: 903000, mungedSequenceNumber: 103, mungedTimestamp: 9001},
+				{sequenceNumber: 5003, timestamp: 909000, mungedSequenceNumber: 105, mungedTimestamp: 15001},
+			},
+		},
+		{
+			name: "rebase across the wraparound",
+			steps: []step{
+				{sequenceNumber: 65535, timestamp: 0xFFFFFFFF, mungedSequenceNumber: 65535, mungedTimestamp: 0xFFFFFFFF},
+				{rebase: true, sequenceNumber: 10, timestamp: 1000, mungedSequenceNumber: 0, mungedTimestamp: 0},
+				{sequenceNumber: 11, timestamp: 4000, mungedSequenceNumber: 1, mungedTimestamp: 3000},
+			},
+		},
+		{
+			name: "rebase before the first packet changes nothing",
+			steps: []step{
+				{rebase: true, sequenceNumber: 100, timestamp: 3000, mungedSequenceNumber: 100, mungedTimestamp: 3000},
+			},
+		},
+		{
+			name: "reordered packets keep their place",
+			steps: []step{
+				{sequenceNumber: 10, timestamp: 1000, mungedSequenceNumber: 10, mungedTimestamp: 1000},
+				{sequenceNumber: 12, timestamp: 2000, mungedSequenceNumber: 12, mungedTimestamp: 2000},
+				{sequenceNumber: 11, timestamp: 1000, mungedSequenceNumber: 11, mungedTimestamp: 1000},
+				// The late packet didn't move the output back
+				{rebase: true, sequenceNumber: 500, timestamp: 50000, mungedSequenceNumber: 13, mungedTimestamp: 2001},
+			},
+		},
+		{
+			name: "packets from before the source started are dropped",
+			steps: []step{
+				{sequenceNumber: 10, timestamp: 1000, mungedSequenceNumber: 10, mungedTimestamp: 1000},
+				{sequenceNumber: 9, timestamp: 1000, dropped: true},
+				{rebase: true, sequenceNumber: 500, timestamp: 50000, mungedSequenceNumber: 11, mungedTimestamp: 1001},
+				// Would be sent as 10 again
+				{sequenceNumber: 499, timestamp: 50000, dropped: true},
+				{sequenceNumber: 501, timestamp: 50000, mungedSequenceNumber: 12, mungedTimestamp: 1001},
+			},
+		},
+		{
+			name: "oldest forwarded sequence number trails the source",
+			steps: []step{
+				{sequenceNumber: 0, timestamp: 0, mungedSequenceNumber: 0, mungedTimestamp: 0},
+				{sequenceNumber: 0x5000, timestamp: 0, mungedSequenceNumber: 0x5000, mungedTimestamp: 0},
+				{sequenceNumber: 0x0FFF, timestamp: 0, dropped: true},
+				{sequenceNumber: 0x1000, timestamp: 0, mungedSequenceNumber: 0x1000, mungedTimestamp: 0},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := &rtpMunger{}
+			for i, s := range test.steps {
+				if s.rebase {
+					m.rebase()
+				}
+
+				// With a clock rate of 1 no time passes between packets, a
+				// rebase advances the timestamp by one tick
+				rtpPkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: s.sequenceNumber, Timestamp: s.timestamp}}
+				if ok := m.munge(rtpPkt, 1); ok == s.dropped {
+					t.Fatalf("step %d: forwarded %t, expected %t", i, ok, !s.dropped)
+				} else if !ok {
+					continue
+				}
+
+				if rtpPkt.SequenceNumber != s.mungedSequenceNumber || rtpPkt.Timestamp != s.mungedTimestamp {
+					t.Fatalf("step %d: expected %d/%d, got %d/%d", i, s.mungedSequenceNumber, s.mungedTimestamp, rtpPkt.SequenceNumber, rtpPkt.Timestamp)
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceNumberNewer(t *testing.T) {
+	for _, test := range []struct {
+		a, b  uint16
+		newer bool
+	}{
+		{a: 2, b: 1, newer: true},
+		{a: 1, b: 2, newer: false},
+		{a: 1, b: 1, newer: false},
+		{a: 0, b: 65535, newer: true},
+		{a: 65535, b: 0, newer: false},
+		{a: 0x7FFF, b: 0, newer: true},
+		{a: 0x8000, b: 0, newer: false},
+	} {
+		if newer := sequenceNumberNewer(test.a, test.b); newer != test.newer {
+			t.Errorf("sequenceNumberNewer(%d, %d) = %t, expected %t", test.a, test.b, newer, test.newer)
+		}
+	}
+}
@@ -1,63 +1,90 @@
 package webrtc
 
 import (
-	"strings"
+	"errors"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
+// trackMultiCodec is a video track that forwards packets of any codec the
+// viewer negotiated, each is sent with the payload type the viewer chose for it
 type trackMultiCodec struct {
 	ssrc        webrtc.SSRC
 	writeStream webrtc.TrackLocalWriter
 
-	h264PayloadType, av1PayloadType uint8
+	payloadTypes map[videoCodec]uint8
+
+	// h264PayloadTypes are keyed by h264Format, H264 is sent with the payload
+	// type of the same profile and packetization-mode if the viewer has one
+	h264PayloadTypes map[string]uint8
+
+	// preferredCodec is bound if the viewer negotiated it, it is what the
+	// publisher is sending
+	preferredCodec videoCodec
 
 	id, rid, streamID string
 }
 
-func GetTrackMultiCodec() *trackMultiCodec {
-	return &trackMultiCodec{id: "video", streamID: "pion"}
-}
+// errVideoCodecNotNegotiated is returned for packets the viewer can't decode
+var errVideoCodecNotNegotiated = errors.New("video codec was not negotiated")
 
 func (t *trackMultiCodec) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
 	t.ssrc = ctx.SSRC()
 	t.writeStream = ctx.WriteStream()
+	t.payloadTypes = map[videoCodec]uint8{}
+	t.h264PayloadTypes = map[string]uint8{}
 
+	var boundCodec *webrtc.RTPCodecParameters
 	codecs := ctx.CodecParameters()
 	for i := range codecs {
-		if t.av1PayloadType == 0 && strings.Contains(
-			strings.ToLower(webrtc.MimeTypeAV1),
-			strings.ToLower(codecs[i].MimeType),
-		) {
-			t.av1PayloadType = uint8(codecs[i].PayloadType)
+		codec := videoCodecFromParameters(codecs[i])
+		if codec == "" {
+			continue
 		}
 
-		if t.h264PayloadType == 0 && strings.Contains(
-			strings.ToLower(webrtc.MimeTypeH264),
-			strings.ToLower(codecs[i].MimeType),
-		) {
-			t.h264PayloadType = uint8(codecs[i].PayloadType)
+		if _, ok := t.payloadTypes[codec]; !ok {
+			t.payloadTypes[codec] = uint8(codecs[i].PayloadType)
 		}
 
+		if format := h264Format(codecs[i].SDPFmtpLine); codec == videoCodecH264 {
+			if _, ok := t.h264PayloadTypes[format]; !ok {
+				t.h264PayloadTypes[format] = uint8(codecs[i].PayloadType)
+			}
+		}
+
+		if boundCodec == nil || (codec == t.preferredCodec && videoCodecFromParameters(*boundCodec) != codec) {
+			boundCodec = &codecs[i]
+		}
 	}
 
-	return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}}, nil
+	if boundCodec == nil {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	return *boundCodec, nil
 }
 
 func (t *trackMultiCodec) Unbind(webrtc.TrackLocalContext) error {
 	return nil
 }
 
-func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, isAV1 bool) error {
-	p.Header.SSRC = uint32(t.ssrc)
+// WriteRTP sends a packet of codec, fmtpLine is what the publisher negotiated for it
+func (t *trackMultiCodec) WriteRTP(p *rtp.Packet, codec videoCodec, fmtpLine string) error {
+	payloadType, ok := t.payloadTypes[codec]
+	if !ok {
+		return errVideoCodecNotNegotiated
+	}
 
-	if isAV1 {
-		p.Header.PayloadType = t.av1PayloadType
-	} else {
-		p.Header.PayloadType = t.h264PayloadType
+	if codec == videoCodecH264 {
+		if h264PayloadType, ok := t.h264PayloadTypes[h264Format(fmtpLine)]; ok {
+			payloadType = h264PayloadType
+		}
 	}
 
+	p.Header.SSRC = uint32(t.ssrc)
+	p.Header.PayloadType = payloadType
+
 	_, err := t.writeStream.WriteRTP(&p.Header, p.Payload)
 	return err
 }
@@ -0,0 +1,288 @@
+package webrtc
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// trickleICE buffers the local candidates of a WHIP/WHEP session that haven't
+// been delivered yet and applies the `application/trickle-ice-sdpfrag` bodies
+// sent to the session resource via PATCH.
+type trickleICE struct {
+	peerConnection *webrtc.PeerConnection
+
+	patchLock sync.Mutex
+
+	candidatesLock    sync.Mutex
+	pendingCandidates []string
+	endOfCandidates   bool
+}
+
+type iceFragment struct {
+	ufrag, pwd string
+	candidates []webrtc.ICECandidateInit
+}
+
+var errICEFragmentMalformed = errors.New("trickle-ice-sdpfrag is malformed")
+
+func newTrickleICE(peerConnection *webrtc.PeerConnection) *trickleICE {
+	t := &trickleICE{peerConnection: peerConnection}
+
+	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		t.candidatesLock.Lock()
+		defer t.candidatesLock.Unlock()
+
+		if c == nil {
+			t.endOfCandidates = true
+			return
+		}
+
+		t.pendingCandidates = append(t.pendingCandidates, c.ToJSON().Candidate)
+	})
+
+	return t
+}
+
+// answer applies the remote offer and returns the local answer. Unless
+// ENABLE_TRICKLE_ICE is set and the offer advertises trickle support we wait
+// for all candidates, clients that don't PATCH would never learn them otherwise.
+func (t *trickleICE) answer(offer string) (string, error) {
+	if err := t.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  offer,
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(t.peerConnection)
+	answer, err := t.peerConnection.CreateAnswer(nil)
+
+	if err != nil {
+		return "", err
+	} else if err = t.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	if os.Getenv("ENABLE_TRICKLE_ICE") == "" || !offerSupportsTrickleICE(offer) {
+		<-gatherComplete
+	}
+
+	// Everything gathered so far is part of the answer
+	t.candidatesLock.Lock()
+	defer t.candidatesLock.Unlock()
+
+	t.pendingCandidates = nil
+	t.endOfCandidates = false
+	return t.peerConnection.LocalDescription().SDP, nil
+}
+
+// patch adds the remote candidates of the fragment, or performs an ICE restart
+// if the fragment carries new credentials. The returned fragment holds the local
+// candidates the remote hasn't seen yet and is empty if there are none.
+func (t *trickleICE) patch(body string) (string, error) {
+	t.patchLock.Lock()
+	defer t.patchLock.Unlock()
+
+	fragment, err := parseICEFragment(body)
+	if err != nil {
+		return "", err
+	}
+
+	remoteUfrag := sdpAttribute(t.peerConnection.RemoteDescription().SDP, "ice-ufrag")
+	if fragment.ufrag != "" && fragment.ufrag != remoteUfrag {
+		return t.restart(fragment)
+	}
+
+	for _, c := range fragment.candidates {
+		if err = t.peerConnection.AddICECandidate(c); err != nil {
+			return "", err
+		}
+	}
+
+	t.candidatesLock.Lock()
+	defer t.candidatesLock.Unlock()
+
+	if len(t.pendingCandidates) == 0 && !t.endOfCandidates {
+		return "", nil
+	}
+
+	out := buildICEFragment(t.peerConnection.LocalDescription().SDP, t.pendingCandidates, t.endOfCandidates)
+	t.pendingCandidates = nil
+	t.endOfCandidates = false
+	return out, nil
+}
+
+// restart re-applies the current remote description with the new credentials,
+// which makes the PeerConnection restart ICE while keeping its media sessions.
+// Candidates are needed in the response, so gathering isn't skipped here.
+func (t *trickleICE) restart(fragment *iceFragment) (string, error) {
+	offer := []string{}
+	for _, line := range splitSDP(t.peerConnection.RemoteDescription().SDP) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + fragment.ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + fragment.pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+
+		offer = append(offer, line)
+	}
+
+	t.candidatesLock.Lock()
+	t.pendingCandidates = nil
+	t.candidatesLock.Unlock()
+
+	if err := t.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		SDP:  strings.Join(offer, "\r\n") + "\r\n",
+		Type: webrtc.SDPTypeOffer,
+	}); err != nil {
+		return "", err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(t.peerConnection)
+	answer, err := t.peerConnection.CreateAnswer(nil)
+
+	if err != nil {
+		return "", err
+	} else if err = t.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	for _, c := range fragment.candidates {
+		if err = t.peerConnection.AddICECandidate(c); err != nil {
+			return "", err
+		}
+	}
+
+	<-gatherComplete
+
+	t.candidatesLock.Lock()
+	defer t.candidatesLock.Unlock()
+
+	t.pendingCandidates = nil
+	t.endOfCandidates = false
+	localDescription := t.peerConnection.LocalDescription().SDP
+	return buildICEFragment(localDescription, sdpCandidates(localDescription), true), nil
+}
+
+func offerSupportsTrickleICE(offer string) bool {
+	for _, line := range splitSDP(offer) {
+		if strings.HasPrefix(line, "a=ice-options:") && strings.Contains(line, "trickle") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func offerHasVideo(offer string) bool {
+	for _, line := range splitSDP(offer) {
+		if strings.HasPrefix(line, "m=video ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseICEFragment(body string) (*iceFragment, error) {
+	fragment := &iceFragment{}
+	mid := ""
+	mLineIndex := -1
+
+	for _, line := range splitSDP(body) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			fragment.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			fragment.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "m="):
+			mLineIndex++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			if mLineIndex == -1 {
+				return nil, errICEFragmentMalformed
+			}
+
+			sdpMid, sdpMLineIndex := mid, uint16(mLineIndex)
+			fragment.candidates = append(fragment.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        &sdpMid,
+				SDPMLineIndex: &sdpMLineIndex,
+			})
+		}
+	}
+
+	if (fragment.ufrag == "") != (fragment.pwd == "") {
+		return nil, errICEFragmentMalformed
+	}
+
+	return fragment, nil
+}
+
+// buildICEFragment creates a trickle-ice-sdpfrag for the first (bundled) media
+// section of localDescription
+func buildICEFragment(localDescription string, candidates []string, complete bool) string {
+	lines := []string{
+		"a=ice-ufrag:" + sdpAttribute(localDescription, "ice-ufrag"),
+		"a=ice-pwd:" + sdpAttribute(localDescription, "ice-pwd"),
+	}
+
+	for _, line := range splitSDP(localDescription) {
+		if strings.HasPrefix(line, "m=") {
+			lines = append(lines, line, "a=mid:"+sdpAttribute(localDescription, "mid"))
+			break
+		}
+	}
+
+	for _, c := range candidates {
+		lines = append(lines, "a="+c)
+	}
+
+	if complete {
+		lines = append(lines, "a=end-of-candidates")
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func sdpCandidates(sdp string) (candidates []string) {
+	seen := map[string]bool{}
+	for _, line := range splitSDP(sdp) {
+		if c := strings.TrimPrefix(line, "a="); strings.HasPrefix(c, "candidate:") && !seen[c] {
+			seen[c] = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	return
+}
+
+// sdpAttribute returns the value of the first `a=name:value` line
+func sdpAttribute(sdp, name string) string {
+	for _, line := range splitSDP(sdp) {
+		if strings.HasPrefix(line, "a="+name+":") {
+			return strings.TrimPrefix(line, "a="+name+":")
+		}
+	}
+
+	return ""
+}
+
+func splitSDP(sdp string) (lines []string) {
+	for _, line := range strings.Split(sdp, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return
+}
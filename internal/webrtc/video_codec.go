@@ -0,0 +1,88 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// videoCodec identifies the codec of forwarded video. VP9 profile 2 can't be
+// decoded by every VP9 decoder, so it is negotiated as a codec of its own.
+type videoCodec string
+
+const (
+	videoCodecH264        videoCodec = "H264"
+	videoCodecH265        videoCodec = "H265"
+	videoCodecAV1         videoCodec = "AV1"
+	videoCodecVP8         videoCodec = "VP8"
+	videoCodecVP9         videoCodec = "VP9"
+	videoCodecVP9Profile2 videoCodec = "VP9 Profile 2"
+)
+
+// ErrVideoCodecNotSupported is returned when a viewer can't decode any of the
+// codecs the broadcaster is sending
+var ErrVideoCodecNotSupported = errors.New("offer doesn't support the video codec of the broadcast")
+
+// videoCodecFromParameters returns the videoCodec of negotiated parameters,
+// or an empty one for codecs that aren't forwarded like RTX
+func videoCodecFromParameters(codec webrtc.RTPCodecParameters) videoCodec {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return videoCodecH264
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return videoCodecH265
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return videoCodecAV1
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return videoCodecVP8
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		if fmtpParameter(codec.SDPFmtpLine, "profile-id") == "2" {
+			return videoCodecVP9Profile2
+		}
+		return videoCodecVP9
+	}
+
+	return ""
+}
+
+// fmtpParameter returns the value of key in a `a=fmtp` parameter list
+func fmtpParameter(fmtpLine, key string) string {
+	for _, parameter := range strings.Split(fmtpLine, ";") {
+		if k, v, found := strings.Cut(strings.TrimSpace(parameter), "="); found && strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// chooseVideoCodec picks the first codec the publisher sends that the viewer
+// negotiated. An error describing both sides is returned if there is none.
+func chooseVideoCodec(publisherCodecs []videoCodec, viewerCodecs map[videoCodec]bool) (videoCodec, error) {
+	for _, codec := range publisherCodecs {
+		if viewerCodecs[codec] {
+			return codec, nil
+		}
+	}
+
+	publisherCodecNames := []string{}
+	for _, codec := range publisherCodecs {
+		publisherCodecNames = append(publisherCodecNames, string(codec))
+	}
+
+	return "", fmt.Errorf("%w, broadcast is sending %s", ErrVideoCodecNotSupported, strings.Join(publisherCodecNames, ", "))
+}
+
+// offeredVideoCodecSet returns the codecs of offer that will be negotiated
+func offeredVideoCodecSet(offer string) map[videoCodec]bool {
+	codecs := map[videoCodec]bool{}
+	for _, codec := range offeredVideoCodecs(offer) {
+		if c := videoCodecFromParameters(codec); c != "" {
+			codecs[c] = true
+		}
+	}
+
+	return codecs
+}
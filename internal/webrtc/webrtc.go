@@ -2,6 +2,7 @@ package webrtc
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -9,9 +10,15 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/ice/v2"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/twcc"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -22,25 +29,53 @@ const (
 type (
 	stream struct {
 		audioTrack       *webrtc.TrackLocalStaticRTP
-		videoTrackLabels []string
-		pliChan          chan any
 		whepSessionsLock sync.RWMutex
 		whepSessions     map[string]*whepSession
+
+		// whipSession is the publisher whose media is forwarded. It is only
+		// replaced with streamMapLock held, but read without it on every packet.
+		whipSession atomic.Pointer[whipSession]
+		whipStandby []*whipSession
+
+		// reconnectTimer deletes the stream if its publisher doesn't come back
+		reconnectTimer *time.Timer
+
+		// Audio is rebased on what was last sent so a new publisher continues it,
+		// video is rebased by the rtpMunger of every viewer
+		audioLock               sync.Mutex
+		lastAudioSequenceNumber uint16
+		lastAudioTimestamp      uint32
+		lastAudioAt             time.Time
+
+		// private streams are hidden from GetAllStreams and require a playback token
+		private bool
+
+		// recorder is set while the stream is recorded
+		recorder atomic.Pointer[recorder]
+
+		// hlsPackager is set while the stream is watched over HLS
+		hlsPackager atomic.Pointer[hlsPackager]
 	}
 )
 
 var (
-	streamMap        map[string]*stream
-	streamMapLock    sync.Mutex
-	apiWhip, apiWhep *webrtc.API
+	errStreamNotFound          = errors.New("stream not found")
+	errWHIPSessionNotFound     = errors.New("whip session not found")
+	errWHEPSessionNotFound     = errors.New("whep session not found")
+	errLayerCodecNotNegotiated = errors.New("layer is sent in a codec the viewer didn't negotiate")
 )
 
-func GetWhepClient() *webrtc.API {
-	return apiWhep
-}
+var (
+	// streamMap is keyed by playback ID
+	streamMap     map[string]*stream
+	streamMapLock sync.Mutex
 
-func getStream(streamKey string) (*stream, error) {
-	foundStream, ok := streamMap[streamKey]
+	whipInterceptorRegistry, whepInterceptorRegistry *interceptor.Registry
+	whipSettingEngine, whepSettingEngine             webrtc.SettingEngine
+)
+
+func getStream(playbackID string) (*stream, error) {
+	foundStream, ok := streamMap[playbackID]
 	if !ok {
 		audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 		if err != nil {
@@ -49,34 +84,56 @@ func getStream(streamKey string) (*stream, error) {
 
 		foundStream = &stream{
 			audioTrack:   audioTrack,
-			pliChan:      make(chan any, 50),
 			whepSessions: map[string]*whepSession{},
 		}
-		streamMap[streamKey] = foundStream
+		streamMap[playbackID] = foundStream
+
+		if recordedPlaybackIDs[playbackID] {
+			foundStream.startRecording(playbackID)
+		}
 	}
 
 	return foundStream, nil
 }
 
-func deleteStream(streamKey string) {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+func (s *stream) close() {
+	s.sendEvent(WHEPEvent{Event: "inactive", Data: "{}"})
 
-	delete(streamMap, streamKey)
-}
+	if s.reconnectTimer != nil {
+		s.reconnectTimer.Stop()
+	}
+
+	if r := s.recorder.Swap(nil); r != nil {
+		r.close()
+	}
 
-func addTrack(stream *stream, rid string) error {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
+	if p := s.hlsPackager.Swap(nil); p != nil {
+		p.close()
+	}
+
+	if active := s.whipSession.Load(); active != nil {
+		active.close()
+	}
+	for _, standby := range s.whipStandby {
+		standby.close()
+	}
 
-	for i := range stream.videoTrackLabels {
-		if rid == stream.videoTrackLabels[i] {
-			return nil
+	s.whepSessionsLock.Lock()
+	defer s.whepSessionsLock.Unlock()
+
+	for whepSessionId, w := range s.whepSessions {
+		w.closeEvents()
+		if err := w.peerConnection.Close(); err != nil {
+			log.Println(err)
 		}
+		delete(s.whepSessions, whepSessionId)
 	}
+}
 
-	stream.videoTrackLabels = append(stream.videoTrackLabels, rid)
-	return nil
+// isActive reports if the publisher of the stream is connected
+func (s *stream) isActive() bool {
+	w := s.whipSession.Load()
+	return w != nil && w.connected.Load()
 }
 
 func getPublicIP() string {
@@ -177,137 +234,129 @@ func createSettingEngine(isWHIP bool, udpMuxCache map[int]*ice.MultiUDPMuxDefaul
 	return
 }
 
-func populateMediaEngine(m *webrtc.MediaEngine) error {
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", nil},
-			PayloadType:        111,
-		},
-	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
-			return err
-		}
+// createWHIPInterceptorRegistry is what RegisterDefaultInterceptors sets up,
+// newMediaEngine already declares the feedback and header extensions they use
+func createWHIPInterceptorRegistry() (*interceptor.Registry, error) {
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return nil, err
 	}
 
-	// nolint
-	videoRTCPFeedback := []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", videoRTCPFeedback},
-			PayloadType:        102,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=102", nil},
-			PayloadType:        121,
-		},
-
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", videoRTCPFeedback},
-			PayloadType:        127,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=127", nil},
-			PayloadType:        120,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", videoRTCPFeedback},
-			PayloadType:        125,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=125", nil},
-			PayloadType:        107,
-		},
-
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", videoRTCPFeedback},
-			PayloadType:        108,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=108", nil},
-			PayloadType:        109,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", videoRTCPFeedback},
-			PayloadType:        127,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=127", nil},
-			PayloadType:        120,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", videoRTCPFeedback},
-			PayloadType:        123,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=123", nil},
-			PayloadType:        118,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeAV1, 90000, 0, "", videoRTCPFeedback},
-			PayloadType:        124,
-		},
-		{
-			// nolint
-			RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=124", nil},
-			PayloadType:        125,
-		},
-	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
-			return err
-		}
+	nackGenerator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
 	}
+	interceptorRegistry.Add(nackGenerator)
 
-	for _, extension := range []string{
-		"urn:ietf:params:rtp-hdrext:sdes:mid",
-		"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
-		"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
-	} {
-		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
-			return err
-		}
+	nackResponder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(nackResponder)
+
+	twccSender, err := twcc.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(twccSender)
+
+	return interceptorRegistry, nil
+}
+
+// newAPI creates the API for a WHIP or WHEP PeerConnection answering offer
+func newAPI(isWHIP bool, offer string) (*webrtc.API, error) {
+	mediaEngine, err := newMediaEngine(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	if isWHIP {
+		return webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(whipInterceptorRegistry),
+			webrtc.WithSettingEngine(whipSettingEngine),
+		), nil
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(whepInterceptorRegistry),
+		webrtc.WithSettingEngine(whepSettingEngine),
+	), nil
+}
+
+// createWHEPInterceptorRegistry is the default interceptors plus bandwidth
+// estimation for the media sent to viewers. The MediaEngine already negotiates
+// NACK and TWCC from RegisterDefaultInterceptors.
+func createWHEPInterceptorRegistry() (*interceptor.Registry, error) {
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	nackResponder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(nackResponder)
+
+	// Media is forwarded as it arrives, so it isn't paced
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBandwidthEstimate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(onNewBandwidthEstimator)
+	interceptorRegistry.Add(congestionController)
+
+	// Interceptors added later see packets first, the estimator needs the
+	// sequence number this one adds
+	twccHeaderExtension, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return nil, err
 	}
+	interceptorRegistry.Add(twccHeaderExtension)
 
-	return nil
+	return interceptorRegistry, nil
 }
 
 func Configure() {
 	streamMap = map[string]*stream{}
+	configurePlaybackIDs()
+	configurePlaybackTokens()
+	configureRecording()
+	configureOrigin()
+	configureDataChannels()
+
+	if os.Getenv("PUBLISHER_RECONNECT_GRACE_PERIOD") != "" {
+		var err error
+		if publisherReconnectGracePeriod, err = time.ParseDuration(os.Getenv("PUBLISHER_RECONNECT_GRACE_PERIOD")); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	mediaEngine := &webrtc.MediaEngine{}
-	if err := populateMediaEngine(mediaEngine); err != nil {
-		panic(err)
+	switch os.Getenv("PUBLISHER_CONFLICT_POLICY") {
+	case "", publisherConflictReplace:
+		publisherConflictPolicy = publisherConflictReplace
+	case publisherConflictReject, publisherConflictStandby:
+		publisherConflictPolicy = os.Getenv("PUBLISHER_CONFLICT_POLICY")
+	default:
+		log.Fatal("PUBLISHER_CONFLICT_POLICY must be one of `reject`, `replace` or `standby`")
 	}
 
-	interceptorRegistry := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+	var err error
+	if whipInterceptorRegistry, err = createWHIPInterceptorRegistry(); err != nil {
+		log.Fatal(err)
+	}
+	if whepInterceptorRegistry, err = createWHEPInterceptorRegistry(); err != nil {
 		log.Fatal(err)
 	}
 
 	udpMuxCache := map[int]*ice.MultiUDPMuxDefault{}
-
-	apiWhip = webrtc.NewAPI(
-		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(true, udpMuxCache)),
-	)
-
-	apiWhep = webrtc.NewAPI(
-		webrtc.WithMediaEngine(mediaEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry),
-		webrtc.WithSettingEngine(createSettingEngine(false, udpMuxCache)),
-	)
+	whipSettingEngine = createSettingEngine(true, udpMuxCache)
+	whepSettingEngine = createSettingEngine(false, udpMuxCache)
 }
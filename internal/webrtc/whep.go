@@ -1,13 +1,15 @@
 package webrtc
 
 import (
-	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
@@ -15,160 +17,360 @@ import (
 
 type (
 	whepSession struct {
+		peerConnection *webrtc.PeerConnection
+		trickleICE     *trickleICE
 		videoTrack     *trackMultiCodec
+		videoCodecs    map[videoCodec]bool
 		currentLayer   atomic.Value
-		sequenceNumber uint16
-		timestamp      uint32
+
+		// packetLock serializes the videoWriters of all layers. pendingLayer is
+		// the layer we switch to once it sends a keyframe. Automatic layer
+		// selection is disabled while the viewer has pinned a layer.
+		packetLock   sync.Mutex
+		pendingLayer string
+		layerPinned  bool
+		rtpMunger    rtpMunger
+
+		// fixedLayer stays pinned when the publisher changes, restreams use it
+		fixedLayer string
+
+		bandwidthEstimator cc.BandwidthEstimator
+		rembBitrate        atomic.Uint64
+
+		// playbackTokenExpiry closes the session when its playback token expires,
+		// it is nil for sessions started without a token
+		playbackTokenExpiry *time.Timer
+
+		// authorized sessions may watch private streams, they are viewers with
+		// a playback token, edges and restreams
+		authorized bool
+
+		eventsLock       sync.Mutex
+		eventSubscribers map[chan WHEPEvent]struct{}
+		eventsClosed     bool
+
+		dataChannels dataChannels
 	}
 
 	simulcastLayerResponse struct {
 		EncodingId string `json:"encodingId"`
+		Codec      string `json:"codec"`
+	}
+
+	whepLayerChangedResponse struct {
+		MediaId    string `json:"mediaId"`
+		EncodingId string `json:"encodingId"`
 	}
 )
 
-func WHEPLayers(whepSessionId string) ([]byte, error) {
+// WHEPChangeLayer pins the viewer to layer, it is switched to once it sends a
+// keyframe. An empty layer or `auto` returns to automatic layer selection.
+func WHEPChangeLayer(whepSessionId, layer string) error {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	layers := []simulcastLayerResponse{}
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+	for playbackID := range streamMap {
+		s := streamMap[playbackID]
+
+		s.whepSessionsLock.RLock()
+		w, ok := s.whepSessions[whepSessionId]
+		s.whepSessionsLock.RUnlock()
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			for i := range streamMap[streamKey].videoTrackLabels {
-				layers = append(layers, simulcastLayerResponse{EncodingId: streamMap[streamKey].videoTrackLabels[i]})
+		if ok {
+			pinned := layer != "" && layer != layerAuto
+			if codec, ok := s.layerCodec(layer); pinned && ok && !w.videoCodecs[codec] {
+				return errLayerCodecNotNegotiated
 			}
 
-			break
+			w.packetLock.Lock()
+			w.layerPinned = pinned
+			w.packetLock.Unlock()
+
+			if pinned {
+				w.requestLayer(s, layer)
+			}
+			return nil
 		}
 	}
 
-	resp := map[string]map[string][]simulcastLayerResponse{
-		"1": map[string][]simulcastLayerResponse{
-			"layers": layers,
-		},
+	return errWHEPSessionNotFound
+}
+
+// WHEP starts playback. bearerToken is either the playback ID of a public
+// stream or a playback token.
+func WHEP(offer, bearerToken string) (string, string, error) {
+	playbackID, claims, err := playbackIDFromBearerToken(bearerToken)
+	if err != nil {
+		return "", "", err
 	}
 
-	return json.Marshal(resp)
+	answer, whepSessionId, _, err := whep(offer, playbackID, claims, false)
+	return answer, whepSessionId, err
 }
 
-func WHEPChangeLayer(whepSessionId, layer string) error {
-	streamMapLock.Lock()
-	defer streamMapLock.Unlock()
-
-	for streamKey := range streamMap {
-		streamMap[streamKey].whepSessionsLock.Lock()
-		defer streamMap[streamKey].whepSessionsLock.Unlock()
+// WHEPEdge starts playback for an edge that authenticated with EDGE_TOKEN, it
+// may pull private streams. It also returns if the stream is private, the edge
+// checks the playback tokens of its own viewers.
+func WHEPEdge(offer, playbackID string) (string, string, bool, error) {
+	return whep(offer, playbackID, nil, true)
+}
 
-		if _, ok := streamMap[streamKey].whepSessions[whepSessionId]; ok {
-			streamMap[streamKey].whepSessions[whepSessionId].currentLayer.Store(layer)
-			streamMap[streamKey].pliChan <- true
+func whep(offer, playbackID string, claims *playbackTokenClaims, edge bool) (string, string, bool, error) {
+	// Edges pull streams they don't have from the origin
+	if originWHEPURL != "" {
+		pulled, err := pullFromOrigin(playbackID)
+		if err != nil {
+			return "", "", false, err
 		}
+		defer func() { go pulled.dropUnwatchedPull() }()
 	}
 
-	return nil
-}
-
-func WHEP(offer, streamKey string) (string, string, error) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
-	stream, err := getStream(streamKey)
+	stream, err := getStream(playbackID)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
+	} else if stream.private && claims == nil && !edge {
+		return "", "", false, ErrPlaybackTokenRequired
 	}
 
 	whepSessionId := uuid.New().String()
 
 	videoTrack := &trackMultiCodec{id: "video", streamID: "pion"}
 
-	peerConnection, err := apiWhep.NewPeerConnection(webrtc.Configuration{})
+	peerConnection, bandwidthEstimator, err := newWHEPPeerConnection(offer)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
 	}
 
+	// Closing the PeerConnection also ends readRTCP
+	closeAndReturn := func(err error) (string, string, bool, error) {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		return "", "", false, err
+	}
+
+	session := &whepSession{
+		peerConnection:     peerConnection,
+		bandwidthEstimator: bandwidthEstimator,
+		trickleICE:         newTrickleICE(peerConnection),
+		videoTrack:         videoTrack,
+		eventSubscribers:   map[chan WHEPEvent]struct{}{},
+		authorized:         claims != nil || edge,
+	}
+	session.currentLayer.Store("")
+
+	peerConnection.OnDataChannel(stream.onViewerDataChannel(session))
+
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
 		if i == webrtc.ICEConnectionStateFailed {
 			if err := peerConnection.Close(); err != nil {
 				log.Println(err)
 			}
 
-			stream.whepSessionsLock.Lock()
-			defer stream.whepSessionsLock.Unlock()
-			delete(stream.whepSessions, whepSessionId)
+			stream.deleteWHEPSession(whepSessionId)
 		}
 	})
 
 	if _, err = peerConnection.AddTrack(stream.audioTrack); err != nil {
-		return "", "", err
+		return closeAndReturn(err)
+	}
+
+	// Offers without video are fine, otherwise one of the codecs the publisher
+	// is sending has to be offered. Before the publisher sends any video there
+	// is nothing to compare against. The codec has to be chosen before the
+	// answer binds the track.
+	if publisherCodecs := stream.videoCodecs(); len(publisherCodecs) != 0 && offerHasVideo(offer) {
+		if videoTrack.preferredCodec, err = chooseVideoCodec(publisherCodecs, offeredVideoCodecSet(offer)); err != nil {
+			return closeAndReturn(err)
+		}
 	}
 
 	rtpSender, err := peerConnection.AddTrack(videoTrack)
 	if err != nil {
-		return "", "", err
+		return closeAndReturn(err)
 	}
 
-	go func() {
-		for {
-			rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
-			if rtcpErr != nil {
-				return
-			}
+	go session.readRTCP(stream, rtpSender)
+
+	answer, err := session.trickleICE.answer(offer)
+	if err != nil {
+		return closeAndReturn(err)
+	}
+	answer = answerH264FmtpLine(answer, stream.h264FmtpLine(), rtpSender.GetParameters().Codecs)
+
+	// Layers are only forwarded in codecs the viewer negotiated
+	session.videoCodecs = map[videoCodec]bool{}
+	for _, codec := range rtpSender.GetParameters().Codecs {
+		if c := videoCodecFromParameters(codec); c != "" {
+			session.videoCodecs[c] = true
+		}
+	}
 
-			for _, r := range rtcpPackets {
-				if _, isPLI := r.(*rtcp.PictureLossIndication); isPLI {
-					select {
-					case stream.pliChan <- true:
-					default:
-					}
-				}
+	stream.whepSessionsLock.Lock()
+	stream.whepSessions[whepSessionId] = session
+	if claims != nil {
+		session.playbackTokenExpiry = time.AfterFunc(time.Until(time.Unix(claims.ExpiresAt, 0)), func() {
+			if stream.deleteWHEPSession(whepSessionId) {
+				log.Printf("Playback token of viewer `%s` expired, closed WHEP session %s", claims.Viewer, whepSessionId)
 			}
+		})
+	}
+	stream.whepSessionsLock.Unlock()
+
+	go session.selectLayers(stream)
+
+	stream.sendViewerCount()
+	return answer, whepSessionId, stream.private, nil
+}
+
+// WHEPPatch trickles candidates or restarts ICE for the viewer session
+func WHEPPatch(whepSessionId, fragment string) (string, error) {
+	streamMapLock.Lock()
+	var trickle *trickleICE
+	for playbackID := range streamMap {
+		streamMap[playbackID].whepSessionsLock.RLock()
+		if w, ok := streamMap[playbackID].whepSessions[whepSessionId]; ok {
+			trickle = w.trickleICE
 		}
-	}()
+		streamMap[playbackID].whepSessionsLock.RUnlock()
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		SDP:  offer,
-		Type: webrtc.SDPTypeOffer,
-	}); err != nil {
-		return "", "", err
+		if trickle != nil {
+			break
+		}
 	}
+	streamMapLock.Unlock()
 
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	if trickle == nil {
+		return "", errWHEPSessionNotFound
+	}
 
-	if err != nil {
-		return "", "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", "", err
+	return trickle.patch(fragment)
+}
+
+// WHEPDelete closes the viewer session and stops forwarding media to it
+func WHEPDelete(whepSessionId string) error {
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	for playbackID := range streamMap {
+		if streamMap[playbackID].deleteWHEPSession(whepSessionId) {
+			return nil
+		}
 	}
 
-	<-gatherComplete
+	return errWHEPSessionNotFound
+}
 
-	stream.whepSessionsLock.Lock()
-	defer stream.whepSessionsLock.Unlock()
+func (s *stream) deleteWHEPSession(whepSessionId string) bool {
+	s.whepSessionsLock.Lock()
+	w, ok := s.whepSessions[whepSessionId]
+	delete(s.whepSessions, whepSessionId)
+	s.whepSessionsLock.Unlock()
+
+	if ok {
+		if w.playbackTokenExpiry != nil {
+			w.playbackTokenExpiry.Stop()
+		}
+
+		w.closeEvents()
+		if err := w.peerConnection.Close(); err != nil {
+			log.Println(err)
+		}
 
-	stream.whepSessions[whepSessionId] = &whepSession{
-		videoTrack: videoTrack,
-		timestamp:  50000,
+		s.sendViewerCount()
+		go s.dropUnwatchedPull()
 	}
-	stream.whepSessions[whepSessionId].currentLayer.Store("")
-	return peerConnection.LocalDescription().SDP, whepSessionId, nil
+
+	return ok
 }
 
-func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, layer string, timeDiff uint32, isAV1 bool) {
-	if w.currentLayer.Load() == "" {
-		w.currentLayer.Store(layer)
-	} else if layer != w.currentLayer.Load() {
-		return
+// deleteUnauthorizedWHEPSessions closes the viewers that joined before the stream became private
+func (s *stream) deleteUnauthorizedWHEPSessions() {
+	s.whepSessionsLock.RLock()
+	whepSessionIds := []string{}
+	for whepSessionId, w := range s.whepSessions {
+		if !w.authorized {
+			whepSessionIds = append(whepSessionIds, whepSessionId)
+		}
 	}
+	s.whepSessionsLock.RUnlock()
 
-	w.sequenceNumber += 1
-	w.timestamp += timeDiff
+	for _, whepSessionId := range whepSessionIds {
+		s.deleteWHEPSession(whepSessionId)
+	}
+}
+
+// readRTCP handles the feedback for the video track until the PeerConnection closes
+func (w *whepSession) readRTCP(s *stream, rtpSender *webrtc.RTPSender) {
+	for {
+		rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
+		if rtcpErr != nil {
+			return
+		}
+
+		for _, r := range rtcpPackets {
+			switch r := r.(type) {
+			case *rtcp.PictureLossIndication:
+				s.sendPLI(w.currentLayer.Load().(string))
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				w.rembBitrate.Store(uint64(r.Bitrate))
+			}
+		}
+	}
+}
+
+// resetLayer makes the session pick the first layer that sends a keyframe,
+// or the fixed layer once it does
+func (w *whepSession) resetLayer() {
+	w.packetLock.Lock()
+	defer w.packetLock.Unlock()
+
+	w.currentLayer.Store("")
+	w.pendingLayer = w.fixedLayer
+	w.layerPinned = w.fixedLayer != ""
+}
 
-	rtpPkt.SequenceNumber = w.sequenceNumber
-	rtpPkt.Timestamp = w.timestamp
+// sendVideoPacket forwards the packets of the current layer. Switching to
+// another layer is deferred until it sends a keyframe, the current layer keeps
+// flowing until then. Returns true if the track should be asked for a keyframe.
+func (w *whepSession) sendVideoPacket(rtpPkt *rtp.Packet, videoTrack *whipVideoTrack) (requestKeyframe bool) {
+	w.packetLock.Lock()
+	defer w.packetLock.Unlock()
 
-	if err := w.videoTrack.WriteRTP(rtpPkt, isAV1); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+	layer, codec := videoTrack.layer, videoTrack.codec
+	if !w.videoCodecs[codec] {
+		return false
+	}
+
+	if currentLayer := w.currentLayer.Load(); layer != currentLayer {
+		if currentLayer == "" && w.pendingLayer == "" {
+			w.pendingLayer = layer
+		}
+
+		if layer != w.pendingLayer {
+			return false
+		} else if !isKeyframe(rtpPkt.Payload, codec) {
+			return true
+		}
+
+		w.currentLayer.Store(layer)
+		w.pendingLayer = ""
+		w.rtpMunger.rebase()
+		w.sendEvent(layerChangedEvent(layer))
+	}
+
+	// The packet is shared by all viewers, only a copy is munged
+	viewerPkt := *rtpPkt
+	if !w.rtpMunger.munge(&viewerPkt, videoTrack.clockRate) {
+		return false
+	}
+
+	// Viewers that can't decode the codec just don't get video
+	if err := w.videoTrack.WriteRTP(&viewerPkt, codec, videoTrack.fmtpLine); err != nil && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, errVideoCodecNotNegotiated) {
 		log.Println(err)
 	}
+
+	return false
 }
@@ -0,0 +1,152 @@
+package webrtc
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// boundCodecRecorder reports the codec every local stream is bound with
+type boundCodecRecorder struct {
+	interceptor.NoOp
+	mimeTypes chan string
+}
+
+func (r *boundCodecRecorder) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return r, nil
+}
+
+func (r *boundCodecRecorder) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	r.mimeTypes <- info.MimeType
+	return writer
+}
+
+// viewerOffer creates the offer of a viewer that can receive codecs in the given order
+func viewerOffer(t *testing.T, codecs ...webrtc.RTPCodecParameters) string {
+	t.Helper()
+
+	m := &webrtc.MediaEngine{}
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConnection.Close() })
+
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = peerConnection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	return peerConnection.LocalDescription().SDP
+}
+
+func TestWHEPBindsCodecOfPublisher(t *testing.T) {
+	Configure()
+
+	recorder := &boundCodecRecorder{mimeTypes: make(chan string, 8)}
+	whepInterceptorRegistry.Add(recorder)
+
+	streamMapLock.Lock()
+	s, err := getStream("av1-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.whipSession.Store(&whipSession{id: "publisher", negotiatedCodecs: []videoCodec{videoCodecAV1}})
+	streamMapLock.Unlock()
+
+	// H264 comes first, it is what the track was bound with when the codec
+	// was chosen too late
+	offer := viewerOffer(t,
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+			PayloadType:        102,
+		},
+		webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+			PayloadType:        45,
+		},
+	)
+
+	_, whepSessionID, err := WHEP(offer, "av1-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { WHEPDelete(whepSessionID) })
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case mimeType := <-recorder.mimeTypes:
+			if !strings.HasPrefix(mimeType, "video/") {
+				continue
+			}
+
+			if !strings.EqualFold(mimeType, webrtc.MimeTypeAV1) {
+				t.Fatalf("video track was bound with %s, expected %s", mimeType, webrtc.MimeTypeAV1)
+			}
+			return
+		case <-timeout:
+			t.Fatal("video track was never bound")
+		}
+	}
+}
+
+func TestWHEPRejectsOfferWithoutCodecOfPublisher(t *testing.T) {
+	Configure()
+
+	streamMapLock.Lock()
+	s, err := getStream("av1-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.whipSession.Store(&whipSession{id: "publisher", negotiatedCodecs: []videoCodec{videoCodecAV1}})
+	streamMapLock.Unlock()
+
+	offer := viewerOffer(t, webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	})
+
+	if _, _, err := WHEP(offer, "av1-only"); err == nil || !strings.Contains(err.Error(), ErrVideoCodecNotSupported.Error()) {
+		t.Fatalf("expected %q, got %v", ErrVideoCodecNotSupported, err)
+	}
+}
+
+func TestFailedWHEPClosesPeerConnection(t *testing.T) {
+	Configure()
+
+	streamMapLock.Lock()
+	if _, err := getStream("failed-viewer"); err != nil {
+		t.Fatal(err)
+	}
+	streamMapLock.Unlock()
+
+	goroutines := runtime.NumGoroutine()
+	if _, _, err := WHEP("not an offer", "failed-viewer"); err == nil {
+		t.Fatal("expected the answer to fail")
+	}
+
+	// The PeerConnection and readRTCP of the viewer are gone
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines before the viewer, %d after it failed", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,14 +5,113 @@ import (
 	"io"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
-func audioWriter(remoteTrack *webrtc.TrackRemote, audioTrack *webrtc.TrackLocalStaticRTP) {
+const (
+	publisherConflictReject  = "reject"
+	publisherConflictReplace = "replace"
+	publisherConflictStandby = "standby"
+
+	publisherStateActive  = "active"
+	publisherStateStandby = "standby"
+
+	defaultPublisherReconnectGracePeriod = 10 * time.Second
+
+	pliInterval = 500 * time.Millisecond
+)
+
+type (
+	whipSession struct {
+		id             string
+		peerConnection *webrtc.PeerConnection
+		trickleICE     *trickleICE
+		startedAt      time.Time
+		connected      atomic.Bool
+
+		// negotiatedCodecs are the video codecs the publisher may send, used
+		// until its tracks arrive. negotiatedH264FmtpLine is the first H264
+		// fmtp line it offered.
+		negotiatedCodecs       []videoCodec
+		negotiatedH264FmtpLine string
+
+		// disconnect ends publishers that aren't WHIP peers. RTMP encoders have
+		// no peerConnection and trickleICE, streams pulled from the origin
+		// have no trickleICE.
+		disconnect func()
+
+		// pulled publishers are the stream of ORIGIN_WHEP_URL, they are
+		// dropped once the last viewer leaves
+		pulled bool
+
+		videoTracksLock sync.RWMutex
+		videoTracks     []*whipVideoTrack
+
+		dataChannels dataChannels
+	}
+
+	whipVideoTrack struct {
+		layer       string
+		codec       videoCodec
+		fmtpLine    string
+		clockRate   uint32
+		remoteTrack *webrtc.TrackRemote
+		lastPLIAt   atomic.Int64
+
+		// bitrate is measured by the videoWriter of the track
+		bitrate        atomic.Uint64
+		bitrateBytes   int
+		bitrateStartAt time.Time
+
+		// metadata is queued by SendMetadata until the next frame, the rest is
+		// only used by the writer of the track
+		metadataLock          sync.Mutex
+		metadata              [][]byte
+		metadataStarted       bool
+		metadataLastTimestamp uint32
+		sequenceNumberOffset  uint16
+	}
+
+	// audioForwarder rebases the audio of a publisher on what the previous
+	// one sent, so viewers don't have to reload
+	audioForwarder struct {
+		forwarding           bool
+		sequenceNumberOffset uint16
+		timestampOffset      uint32
+	}
+
+	StreamStatus struct {
+		PlaybackID string            `json:"playbackId"`
+		Publishers []PublisherStatus `json:"publishers"`
+		Recording  bool              `json:"recording"`
+	}
+
+	PublisherStatus struct {
+		State     string    `json:"state"`
+		StartedAt time.Time `json:"startedAt"`
+	}
+)
+
+// ErrPublisherConflict is returned when a stream already has a publisher and
+// PUBLISHER_CONFLICT_POLICY is `reject`
+var ErrPublisherConflict = errors.New("stream already has a publisher")
+
+var (
+	publisherConflictPolicy       = publisherConflictReplace
+	publisherReconnectGracePeriod = defaultPublisherReconnectGracePeriod
+)
+
+func audioWriter(remoteTrack *webrtc.TrackRemote, s *stream, w *whipSession) {
 	rtpBuf := make([]byte, 1500)
+	rtpPkt := &rtp.Packet{}
+	forwarder := &audioForwarder{}
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
@@ -23,45 +122,76 @@ func audioWriter(remoteTrack *webrtc.TrackRemote, audioTrack *webrtc.TrackLocalS
 			return
 		}
 
-		if _, writeErr := audioTrack.Write(rtpBuf[:rtpRead]); writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
-			log.Println(writeErr)
+		if s.whipSession.Load() != w {
+			forwarder.forwarding = false
+			continue
+		}
+
+		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
+			log.Println(err)
+			return
+		}
+
+		if err = s.writeAudio(forwarder, rtpPkt, remoteTrack.Codec().ClockRate); err != nil {
+			log.Println(err)
 			return
 		}
 	}
 }
 
-func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection *webrtc.PeerConnection, s *stream) {
+// writeAudio sends a packet of the active publisher to viewers, the recording
+// and HLS
+func (s *stream) writeAudio(f *audioForwarder, rtpPkt *rtp.Packet, clockRate uint32) error {
+	s.audioLock.Lock()
+	// Continue where the previous publisher left off so viewers don't have to reload
+	if !f.forwarding {
+		f.forwarding = true
+		f.sequenceNumberOffset, f.timestampOffset = 0, 0
+		if !s.lastAudioAt.IsZero() {
+			f.sequenceNumberOffset = s.lastAudioSequenceNumber + 1 - rtpPkt.SequenceNumber
+			f.timestampOffset = s.lastAudioTimestamp + elapsedRTPTime(s.lastAudioAt, clockRate) - rtpPkt.Timestamp
+		}
+	}
+
+	rtpPkt.SequenceNumber += f.sequenceNumberOffset
+	rtpPkt.Timestamp += f.timestampOffset
+	s.lastAudioSequenceNumber, s.lastAudioTimestamp, s.lastAudioAt = rtpPkt.SequenceNumber, rtpPkt.Timestamp, time.Now()
+	s.audioLock.Unlock()
+
+	if err := s.audioTrack.WriteRTP(rtpPkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+
+	s.recordAudio(rtpPkt)
+	s.packageHLSAudio(rtpPkt)
+	return nil
+}
+
+// elapsedRTPTime converts the time since t to RTP timestamp units
+func elapsedRTPTime(t time.Time, clockRate uint32) uint32 {
+	return uint32(time.Since(t).Seconds() * float64(clockRate))
+}
+
+func videoWriter(remoteTrack *webrtc.TrackRemote, s *stream, w *whipSession) {
 	id := remoteTrack.RID()
 	if id == "" {
 		id = videoTrackLabelDefault
 	}
 
-	if err := addTrack(s, id); err != nil {
-		log.Println(err)
-		return
+	codec := remoteTrack.Codec()
+	videoTrack := &whipVideoTrack{
+		layer:       id,
+		codec:       videoCodecFromParameters(codec),
+		fmtpLine:    codec.SDPFmtpLine,
+		clockRate:   codec.ClockRate,
+		remoteTrack: remoteTrack,
 	}
 
-	go func() {
-		for range stream.pliChan {
-			if sendErr := peerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(remoteTrack.SSRC()),
-				},
-			}); sendErr != nil {
-				return
-			}
-		}
-	}()
-
-	isAV1 :=
-		strings.Contains(
-			strings.ToLower(webrtc.MimeTypeAV1),
-			strings.ToLower(remoteTrack.Codec().RTPCodecCapability.MimeType),
-		)
+	s.addTrack(w, videoTrack)
+	defer s.removeTrack(w, id)
 
 	rtpBuf := make([]byte, 1500)
 	rtpPkt := &rtp.Packet{}
-	lastTimestamp := uint32(0)
 	for {
 		rtpRead, _, err := remoteTrack.Read(rtpBuf)
 		switch {
@@ -72,82 +202,486 @@ func videoWriter(remoteTrack *webrtc.TrackRemote, stream *stream, peerConnection
 			return
 		}
 
+		videoTrack.updateBitrate(rtpRead)
+		if s.whipSession.Load() != w {
+			continue
+		}
+
 		if err = rtpPkt.Unmarshal(rtpBuf[:rtpRead]); err != nil {
 			log.Println(err)
 			return
 		}
 
-		timeDiff := rtpPkt.Timestamp - lastTimestamp
-		if lastTimestamp == 0 {
-			timeDiff = 0
+		s.writeVideo(w, videoTrack, rtpPkt)
+	}
+}
+
+// writeVideo sends a packet of the active publisher to viewers, the recording
+// and HLS, along with the metadata that was queued for it. A keyframe is
+// requested if any of them needs one.
+func (s *stream) writeVideo(w *whipSession, videoTrack *whipVideoTrack, rtpPkt *rtp.Packet) {
+	requestKeyframe := false
+	for _, pkt := range videoTrack.withMetadata(rtpPkt) {
+		if s.recordVideo(videoTrack, pkt) {
+			requestKeyframe = true
+		}
+		if s.packageHLSVideo(videoTrack, pkt) {
+			requestKeyframe = true
 		}
-		lastTimestamp = rtpPkt.Timestamp
 
 		s.whepSessionsLock.RLock()
 		for i := range s.whepSessions {
-			s.whepSessions[i].sendVideoPacket(rtpPkt, id, timeDiff, isAV1)
+			if s.whepSessions[i].sendVideoPacket(pkt, videoTrack) {
+				requestKeyframe = true
+			}
 		}
 		s.whepSessionsLock.RUnlock()
 	}
-}
 
-func WHIP(offer, streamKey string) (string, error) {
-	peerConnection, err := apiWhip.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		return "", err
+	if requestKeyframe {
+		w.sendPLI(videoTrack)
 	}
+}
+
+// WHIP starts a broadcast. Private streams can only be watched with a playback token.
+func WHIP(offer, streamKey string, private bool) (string, string, error) {
+	playbackID := PlaybackID(streamKey)
 
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
-	stream, err := getStream(streamKey)
+	stream, err := getStream(playbackID)
+	if err != nil {
+		return "", "", err
+	}
+
+	activeSession, err := stream.admitPublisher()
+	if err != nil {
+		return "", "", err
+	}
+
+	api, err := newAPI(true, offer)
+	if err != nil {
+		return "", "", err
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	session := &whipSession{
+		id:             uuid.New().String(),
+		peerConnection: peerConnection,
+		trickleICE:     newTrickleICE(peerConnection),
+		startedAt:      time.Now(),
 	}
 
 	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, rtpReceiver *webrtc.RTPReceiver) {
 		if strings.HasPrefix(remoteTrack.Codec().RTPCodecCapability.MimeType, "audio") {
-			audioWriter(remoteTrack, stream.audioTrack)
+			audioWriter(remoteTrack, stream, session)
 		} else {
-			videoWriter(remoteTrack, stream, peerConnection, stream)
-
+			videoWriter(remoteTrack, stream, session)
 		}
 	})
 
+	peerConnection.OnDataChannel(stream.onPublisherDataChannel(session))
+
 	peerConnection.OnICEConnectionStateChange(func(i webrtc.ICEConnectionState) {
-		if i == webrtc.ICEConnectionStateFailed {
+		switch i {
+		case webrtc.ICEConnectionStateConnected:
+			if !session.connected.Swap(true) && stream.whipSession.Load() == session {
+				stream.sendEvent(stream.activeEvent())
+			}
+		case webrtc.ICEConnectionStateFailed:
 			if err := peerConnection.Close(); err != nil {
 				log.Println(err)
 			}
-			deleteStream(streamKey)
+			if err := disconnectWHIPSession(playbackID, session.id); err != nil {
+				log.Println(err)
+			}
 		}
 	})
 
-	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		SDP:  string(offer),
-		Type: webrtc.SDPTypeOffer,
-	}); err != nil {
-		return "", err
+	answer, err := session.trickleICE.answer(offer)
+	if err != nil {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		return "", "", err
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			for _, codec := range transceiver.Receiver().GetParameters().Codecs {
+				c := videoCodecFromParameters(codec)
+				if c != "" {
+					session.negotiatedCodecs = append(session.negotiatedCodecs, c)
+				}
 
-	if err != nil {
-		return "", err
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+				if c == videoCodecH264 && session.negotiatedH264FmtpLine == "" {
+					session.negotiatedH264FmtpLine = codec.SDPFmtpLine
+				}
+			}
+		}
 	}
 
-	<-gatherComplete
-	return peerConnection.LocalDescription().SDP, nil
+	stream.addPublisher(session, activeSession, private)
+	return answer, session.id, nil
 }
 
-func GetAllStreams() (out []string) {
+// admitPublisher checks PUBLISHER_CONFLICT_POLICY before a publisher is set up.
+// It returns the active publisher, it must be called with streamMapLock held.
+func (s *stream) admitPublisher() (*whipSession, error) {
+	activeSession := s.whipSession.Load()
+	if activeSession != nil && publisherConflictPolicy == publisherConflictReject {
+		return nil, ErrPublisherConflict
+	}
+
+	return activeSession, nil
+}
+
+// addPublisher makes session the active publisher or a standby, following
+// PUBLISHER_CONFLICT_POLICY, and stops waiting for the previous one to
+// reconnect. Until then a publisher that fails to set up leaves the timer
+// running. Viewers without a playback token are only closed when a public
+// stream becomes private. It must be called with streamMapLock held.
+func (s *stream) addPublisher(session, activeSession *whipSession, private bool) {
+	if s.reconnectTimer != nil {
+		s.reconnectTimer.Stop()
+		s.reconnectTimer = nil
+	}
+
+	if private && !s.private {
+		s.deleteUnauthorizedWHEPSessions()
+	}
+	s.private = private
+
+	switch {
+	case activeSession == nil:
+		s.whipSession.Store(session)
+		s.publisherChanged()
+	case publisherConflictPolicy == publisherConflictStandby:
+		s.whipStandby = append(s.whipStandby, session)
+	default:
+		s.whipSession.Store(session)
+		activeSession.close()
+		s.publisherChanged()
+	}
+}
+
+// WHIPPatch trickles candidates or restarts ICE for the publisher of whipSessionId
+func WHIPPatch(whipSessionId, fragment string) (string, error) {
+	streamMapLock.Lock()
+	_, session := findWHIPSession(whipSessionId)
+	streamMapLock.Unlock()
+
+	if session == nil || session.trickleICE == nil {
+		return "", errWHIPSessionNotFound
+	}
+
+	return session.trickleICE.patch(fragment)
+}
+
+// WHIPDelete ends the broadcast owned by whipSessionId. If the stream has a
+// standby publisher it takes over instead.
+func WHIPDelete(whipSessionId string) error {
+	streamMapLock.Lock()
+	playbackID, session := findWHIPSession(whipSessionId)
+	streamMapLock.Unlock()
+
+	if session == nil {
+		return errWHIPSessionNotFound
+	}
+
+	return deleteWHIPSession(playbackID, whipSessionId)
+}
+
+// findWHIPSession must be called with streamMapLock held
+func findWHIPSession(whipSessionId string) (string, *whipSession) {
+	for playbackID, s := range streamMap {
+		if active := s.whipSession.Load(); active != nil && active.id == whipSessionId {
+			return playbackID, active
+		}
+
+		for _, standby := range s.whipStandby {
+			if standby.id == whipSessionId {
+				return playbackID, standby
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// deleteWHIPSession removes a publisher from the stream. When the active
+// publisher leaves the first standby is promoted, if there is none the stream is
+// deleted and its viewers are closed so they learn the broadcast is over.
+func deleteWHIPSession(playbackID, whipSessionId string) error {
+	streamMapLock.Lock()
+	s, ok := streamMap[playbackID]
+	if !ok {
+		streamMapLock.Unlock()
+		return errStreamNotFound
+	}
+
+	if active := s.whipSession.Load(); active != nil && active.id == whipSessionId {
+		if len(s.whipStandby) == 0 {
+			delete(streamMap, playbackID)
+			streamMapLock.Unlock()
+
+			s.close()
+			return nil
+		}
+
+		s.whipSession.Store(s.whipStandby[0])
+		s.whipStandby = s.whipStandby[1:]
+		streamMapLock.Unlock()
+
+		active.close()
+		s.publisherChanged()
+		return nil
+	}
+
+	for i, standby := range s.whipStandby {
+		if standby.id == whipSessionId {
+			s.whipStandby = append(s.whipStandby[:i], s.whipStandby[i+1:]...)
+			streamMapLock.Unlock()
+
+			standby.close()
+			return nil
+		}
+	}
+
+	streamMapLock.Unlock()
+	return errWHIPSessionNotFound
+}
+
+// disconnectWHIPSession handles a publisher that lost its connection. If it
+// was the only one the stream is kept for PUBLISHER_RECONNECT_GRACE_PERIOD,
+// viewers stay attached and resume once the publisher reconnects.
+func disconnectWHIPSession(playbackID, whipSessionId string) error {
+	streamMapLock.Lock()
+	s, ok := streamMap[playbackID]
+	if !ok {
+		streamMapLock.Unlock()
+		return errStreamNotFound
+	}
+
+	active := s.whipSession.Load()
+	if publisherReconnectGracePeriod == 0 || active == nil || active.id != whipSessionId || len(s.whipStandby) != 0 {
+		streamMapLock.Unlock()
+		return deleteWHIPSession(playbackID, whipSessionId)
+	}
+
+	s.whipSession.Store(nil)
+	s.reconnectTimer = time.AfterFunc(publisherReconnectGracePeriod, func() {
+		streamMapLock.Lock()
+		if streamMap[playbackID] != s || s.whipSession.Load() != nil {
+			streamMapLock.Unlock()
+			return
+		}
+		delete(streamMap, playbackID)
+		streamMapLock.Unlock()
+
+		s.close()
+	})
+	streamMapLock.Unlock()
+
+	active.close()
+	s.publisherChanged()
+	return nil
+}
+
+// publisherChanged tells viewers about the layers of the new publisher and asks
+// it for a keyframe
+func (s *stream) publisherChanged() {
+	s.whepSessionsLock.RLock()
+	for i := range s.whepSessions {
+		s.whepSessions[i].resetLayer()
+	}
+	s.whepSessionsLock.RUnlock()
+
+	if r := s.recorder.Load(); r != nil {
+		r.publisherChanged()
+	}
+
+	if p := s.hlsPackager.Load(); p != nil {
+		p.publisherChanged()
+	}
+
+	s.sendLayersEvent()
+	s.sendEvent(s.activeEvent())
+	s.sendPLI("")
+}
+
+func (s *stream) addTrack(w *whipSession, videoTrack *whipVideoTrack) {
+	w.videoTracksLock.Lock()
+	w.videoTracks = append(w.videoTracks, videoTrack)
+	w.videoTracksLock.Unlock()
+
+	if s.whipSession.Load() == w {
+		s.sendLayersEvent()
+	}
+}
+
+// videoCodecs returns the codecs the active publisher is sending, or could
+// send if no video arrived yet
+func (s *stream) videoCodecs() (codecs []videoCodec) {
+	w := s.whipSession.Load()
+	if w == nil {
+		return nil
+	}
+
+	w.videoTracksLock.RLock()
+	defer w.videoTracksLock.RUnlock()
+
+	if len(w.videoTracks) == 0 {
+		return w.negotiatedCodecs
+	}
+
+	seen := map[videoCodec]bool{}
+	for _, t := range w.videoTracks {
+		if !seen[t.codec] {
+			seen[t.codec] = true
+			codecs = append(codecs, t.codec)
+		}
+	}
+
+	return
+}
+
+// h264FmtpLine returns the fmtp line of the H264 video the active publisher
+// is sending, or offered to send if no video arrived yet
+func (s *stream) h264FmtpLine() string {
+	w := s.whipSession.Load()
+	if w == nil {
+		return ""
+	}
+
+	w.videoTracksLock.RLock()
+	defer w.videoTracksLock.RUnlock()
+
+	for _, t := range w.videoTracks {
+		if t.codec == videoCodecH264 {
+			return t.fmtpLine
+		}
+	}
+
+	return w.negotiatedH264FmtpLine
+}
+
+// layerCodec returns the codec of a layer of the active publisher
+func (s *stream) layerCodec(layer string) (videoCodec, bool) {
+	w := s.whipSession.Load()
+	if w == nil {
+		return "", false
+	}
+
+	w.videoTracksLock.RLock()
+	defer w.videoTracksLock.RUnlock()
+
+	for _, t := range w.videoTracks {
+		if t.layer == layer {
+			return t.codec, true
+		}
+	}
+
+	return "", false
+}
+
+func (s *stream) removeTrack(w *whipSession, layer string) {
+	w.videoTracksLock.Lock()
+	for i := range w.videoTracks {
+		if w.videoTracks[i].layer == layer {
+			w.videoTracks = append(w.videoTracks[:i], w.videoTracks[i+1:]...)
+			break
+		}
+	}
+	w.videoTracksLock.Unlock()
+
+	if s.whipSession.Load() == w {
+		if r := s.recorder.Load(); r != nil {
+			r.trackRemoved(layer)
+		}
+
+		if p := s.hlsPackager.Load(); p != nil {
+			p.trackRemoved(layer)
+		}
+
+		s.sendLayersEvent()
+	}
+}
+
+// sendPLI requests a keyframe from the active publisher for layer, or for
+// every layer if it is empty
+func (s *stream) sendPLI(layer string) {
+	w := s.whipSession.Load()
+	if w == nil {
+		return
+	}
+
+	w.videoTracksLock.RLock()
+	defer w.videoTracksLock.RUnlock()
+
+	for _, t := range w.videoTracks {
+		if layer == "" || t.layer == layer {
+			w.sendPLI(t)
+		}
+	}
+}
+
+// sendPLI is rate limited, every viewer waiting for the same keyframe would
+// request it otherwise
+func (w *whipSession) sendPLI(t *whipVideoTrack) {
+	// Keyframes can't be requested from encoders that aren't WebRTC peers
+	if w.peerConnection == nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	if lastPLIAt := t.lastPLIAt.Load(); now-lastPLIAt < int64(pliInterval) || !t.lastPLIAt.CompareAndSwap(lastPLIAt, now) {
+		return
+	}
+
+	if err := w.peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{
+			MediaSSRC: uint32(t.remoteTrack.SSRC()),
+		},
+	}); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Println(err)
+	}
+}
+
+func (w *whipSession) close() {
+	if w.disconnect != nil {
+		w.disconnect()
+		return
+	}
+
+	if err := w.peerConnection.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// GetAllStreams returns the status of all public streams
+func GetAllStreams() (out []StreamStatus) {
 	streamMapLock.Lock()
 	defer streamMapLock.Unlock()
 
-	for s := range streamMap {
-		out = append(out, s)
+	for playbackID, s := range streamMap {
+		if s.private {
+			continue
+		}
+
+		status := StreamStatus{PlaybackID: playbackID, Publishers: []PublisherStatus{}, Recording: s.recorder.Load() != nil}
+		if active := s.whipSession.Load(); active != nil {
+			status.Publishers = append(status.Publishers, PublisherStatus{State: publisherStateActive, StartedAt: active.startedAt})
+		}
+		for _, standby := range s.whipStandby {
+			status.Publishers = append(status.Publishers, PublisherStatus{State: publisherStateStandby, StartedAt: standby.startedAt})
+		}
+
+		out = append(out, status)
 	}
 
 	return
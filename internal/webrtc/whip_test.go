@@ -0,0 +1,91 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestFailedWHIPKeepsWaitingForPublisher(t *testing.T) {
+	Configure()
+	publisherReconnectGracePeriod = 50 * time.Millisecond
+	t.Cleanup(func() { publisherReconnectGracePeriod = defaultPublisherReconnectGracePeriod })
+
+	streamKey := "reconnecting"
+	playbackID := PlaybackID(streamKey)
+
+	streamMapLock.Lock()
+	s, err := getStream(playbackID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addPublisher(&whipSession{id: "disconnected", disconnect: func() {}}, nil, false)
+	streamMapLock.Unlock()
+
+	if err = disconnectWHIPSession(playbackID, "disconnected"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = WHIP("not an offer", streamKey, false); err == nil {
+		t.Fatal("WHIP accepted an invalid offer")
+	}
+
+	time.Sleep(publisherReconnectGracePeriod * 4)
+
+	streamMapLock.Lock()
+	_, ok := streamMap[playbackID]
+	streamMapLock.Unlock()
+
+	if ok {
+		t.Fatal("stream was kept after the grace period of its publisher")
+	}
+}
+
+func TestPrivatePublisherOnlyEvictsWhenStreamBecomesPrivate(t *testing.T) {
+	Configure()
+
+	streamMapLock.Lock()
+	defer streamMapLock.Unlock()
+
+	s, err := getStream(PlaybackID("becoming-private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addViewer := func(id string, authorized bool) {
+		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = peerConnection.Close() })
+
+		s.whepSessionsLock.Lock()
+		s.whepSessions[id] = &whepSession{peerConnection: peerConnection, authorized: authorized}
+		s.whepSessionsLock.Unlock()
+	}
+	viewers := func() (ids []string) {
+		s.whepSessionsLock.RLock()
+		defer s.whepSessionsLock.RUnlock()
+		for id := range s.whepSessions {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	s.addPublisher(&whipSession{id: "public", disconnect: func() {}}, nil, false)
+	addViewer("anonymous", false)
+	addViewer("edge", true)
+
+	s.addPublisher(&whipSession{id: "private", disconnect: func() {}}, s.whipSession.Load(), true)
+	if ids := viewers(); len(ids) != 1 || ids[0] != "edge" {
+		t.Fatalf("viewers after the stream became private = %v, want [edge]", ids)
+	}
+
+	// A publisher reconnecting to a stream that is already private keeps its viewers
+	addViewer("token", true)
+	s.addPublisher(&whipSession{id: "reconnected", disconnect: func() {}}, s.whipSession.Load(), true)
+	if ids := viewers(); len(ids) != 2 {
+		t.Fatalf("viewers after the publisher reconnected = %v, want [edge token]", ids)
+	}
+}
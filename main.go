@@ -6,14 +6,21 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"crypto/subtle"
 	"crypto/tls"
 	"log"
 	"net/http"
 
+	"github.com/glimesh/broadcast-box/internal/authorization"
 	"github.com/glimesh/broadcast-box/internal/relay"
+	"github.com/glimesh/broadcast-box/internal/rtmp"
 	"github.com/glimesh/broadcast-box/internal/webrtc"
 	"github.com/joho/godotenv"
 )
@@ -21,6 +28,16 @@ import (
 const (
 	envFileProd = ".env.production"
 	envFileDev  = ".env.development"
+
+	trickleICEContentType = "application/trickle-ice-sdpfrag"
+
+	sseHeartbeatInterval = 15 * time.Second
+
+	defaultPlaybackTokenExpiresIn = 60 * 60
+
+	// metadataRequestMaxSize bounds what is read of a metadata request, larger
+	// metadata than a packet holds is rejected by webrtc.SendMetadata anyway
+	metadataRequestMaxSize = 64 * 1024
 )
 
 type (
@@ -28,6 +45,21 @@ type (
 		MediaId    string `json:"mediaId"`
 		EncodingId string `json:"encodingId"`
 	}
+
+	playbackTokenRequestJSON struct {
+		PlaybackID string `json:"playbackId"`
+		ViewerID   string `json:"viewerId"`
+		ExpiresIn  int64  `json:"expiresIn"`
+	}
+
+	playbackTokenResponseJSON struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+
+	recordingRequestJSON struct {
+		StreamKey string `json:"streamKey"`
+	}
 )
 
 func logHTTPError(w http.ResponseWriter, err string, code int) {
@@ -35,8 +67,13 @@ func logHTTPError(w http.ResponseWriter, err string, code int) {
 	http.Error(w, err, code)
 }
 
+// bearerToken returns the Authorization header without the `Bearer ` prefix
+func bearerToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
 func whipHandler(res http.ResponseWriter, r *http.Request) {
-	streamKey := r.Header.Get("Authorization")
+	streamKey := bearerToken(r)
 	if streamKey == "" {
 		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
 		return
@@ -48,20 +85,67 @@ func whipHandler(res http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer, err := webrtc.WHIP(string(offer), streamKey)
-	if err != nil {
+	grant, err := authorization.AuthorizePublish(authorization.NewPublishRequest(streamKey, r.RemoteAddr, r.UserAgent(), string(offer)))
+	if errors.Is(err, authorization.ErrUnauthorized) {
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	streamKey = grant.StreamKey
+
+	answer, whipSessionId, err := webrtc.WHIP(string(offer), streamKey, grant.Private)
+	if errors.Is(err, webrtc.ErrPublisherConflict) {
+		logHTTPError(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	res.Header().Add("Location", "/api/whip")
+	res.Header().Add("Link", `</`+webrtc.PlaybackID(streamKey)+`>; rel="alternate"`)
+	res.Header().Add("Location", "/api/whip/"+whipSessionId)
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
-func whepHandler(res http.ResponseWriter, req *http.Request) {
-	streamKey := req.Header.Get("Authorization")
+// rtmpPublishHandler authorizes RTMP encoders like whipHandler does WHIP publishers
+func rtmpPublishHandler(streamKey, remoteAddress, flashVersion string, disconnect func()) (rtmp.Publisher, error) {
 	if streamKey == "" {
+		return nil, errors.New("stream key was not set")
+	}
+
+	grant, err := authorization.AuthorizePublish(authorization.NewPublishRequest(streamKey, remoteAddress, flashVersion, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	return webrtc.StartIngest(grant.StreamKey, grant.Private, disconnect)
+}
+
+func whipSessionHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whipSessionId := vals[len(vals)-1]
+
+	switch req.Method {
+	case http.MethodPatch:
+		trickleICEHandler(res, req, func(fragment string) (string, error) {
+			return webrtc.WHIPPatch(whipSessionId, fragment)
+		})
+	case http.MethodDelete:
+		if err := webrtc.WHIPDelete(whipSessionId); err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func whepHandler(res http.ResponseWriter, req *http.Request) {
+	playbackIDOrToken := bearerToken(req)
+	if playbackIDOrToken == "" {
 		logHTTPError(res, "Authorization was not set", http.StatusBadRequest)
 		return
 	}
@@ -72,20 +156,89 @@ func whepHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	answer, whepSessionId, err := webrtc.WHEP(string(offer), streamKey)
-	if err != nil {
+	// Edges authenticate with EDGE_TOKEN and name the stream they pull in the query
+	var answer, whepSessionId string
+	edge, private := webrtc.IsEdgeToken(playbackIDOrToken), false
+	if edge {
+		playbackID := req.URL.Query().Get("playbackId")
+		if playbackID == "" {
+			logHTTPError(res, "playbackId was not set", http.StatusBadRequest)
+			return
+		}
+		answer, whepSessionId, private, err = webrtc.WHEPEdge(string(offer), playbackID)
+	} else {
+		answer, whepSessionId, err = webrtc.WHEP(string(offer), playbackIDOrToken)
+	}
+
+	if errors.Is(err, webrtc.ErrPlaybackTokenRequired) || errors.Is(err, webrtc.ErrPlaybackTokenInvalid) {
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, webrtc.ErrVideoCodecNotSupported) {
+		logHTTPError(res, err.Error(), http.StatusNotAcceptable)
+		return
+	} else if errors.Is(err, webrtc.ErrOriginUnavailable) {
+		logHTTPError(res, err.Error(), http.StatusBadGateway)
+		return
+	} else if err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	apiPath := req.Host + strings.TrimSuffix(req.URL.RequestURI(), "whep")
-	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers"`)
+	res.Header().Add("Link", `<`+apiPath+"sse/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:server-sent-events"; events="layers,active,inactive,viewercount,layer-changed"`)
 	res.Header().Add("Link", `<`+apiPath+"layer/"+whepSessionId+`>; rel="urn:ietf:params:whep:ext:core:layer"`)
-	res.Header().Add("Location", "/api/whep")
+	res.Header().Add("Location", "/api/whep/"+whepSessionId)
+	if edge {
+		res.Header().Set(webrtc.PrivateStreamHeader, strconv.FormatBool(private))
+	}
 	res.WriteHeader(http.StatusCreated)
 	fmt.Fprint(res, answer)
 }
 
+func whepSessionHandler(res http.ResponseWriter, req *http.Request) {
+	vals := strings.Split(req.URL.RequestURI(), "/")
+	whepSessionId := vals[len(vals)-1]
+
+	switch req.Method {
+	case http.MethodPatch:
+		trickleICEHandler(res, req, func(fragment string) (string, error) {
+			return webrtc.WHEPPatch(whepSessionId, fragment)
+		})
+	case http.MethodDelete:
+		if err := webrtc.WHEPDelete(whepSessionId); err != nil {
+			logHTTPError(res, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func trickleICEHandler(res http.ResponseWriter, req *http.Request, patch func(string) (string, error)) {
+	if req.Header.Get("Content-Type") != trickleICEContentType {
+		logHTTPError(res, "Content-Type must be "+trickleICEContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	fragment, err := io.ReadAll(req.Body)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := patch(string(fragment))
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if answer == "" {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	res.Header().Set("Content-Type", trickleICEContentType)
+	fmt.Fprint(res, answer)
+}
+
 func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "text/event-stream")
 	res.Header().Set("Cache-Control", "no-cache")
@@ -94,15 +247,39 @@ func whepServerSentEventsHandler(res http.ResponseWriter, req *http.Request) {
 	vals := strings.Split(req.URL.RequestURI(), "/")
 	whepSessionId := vals[len(vals)-1]
 
-	layers, err := webrtc.WHEPLayers(whepSessionId)
+	events, unsubscribe, err := webrtc.WHEPSubscribe(whepSessionId)
 	if err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer unsubscribe()
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		logHTTPError(res, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(res, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			fmt.Fprintf(res, "event: %s\n", event.Event)
+			fmt.Fprintf(res, "data: %s\n\n", event.Data)
+		}
 
-	fmt.Fprint(res, "event: layers\n")
-	fmt.Fprintf(res, "data: %s\n", string(layers))
-	fmt.Fprint(res, "\n\n")
+		flusher.Flush()
+	}
 }
 
 func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
@@ -121,21 +298,276 @@ func whepLayerHandler(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-type StreamStatus struct {
-	StreamKey string `json:"streamKey"`
+// hlsHandler serves /api/hls/{stream}/..., stream is a playback ID or a playback token
+func hlsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playbackIDOrToken, file, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/api/hls/"), "/")
+	if !ok || playbackIDOrToken == "" || file == "" {
+		logHTTPError(res, "Invalid HLS path", http.StatusNotFound)
+		return
+	}
+
+	msn, part, err := webrtc.HLSBlockingQuery(req.URL.Query().Get("_HLS_msn"), req.URL.Query().Get("_HLS_part"))
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, contentType, err := webrtc.HLS(req.Context(), playbackIDOrToken, file, msn, part)
+	switch {
+	case errors.Is(err, webrtc.ErrPlaybackTokenRequired) || errors.Is(err, webrtc.ErrPlaybackTokenInvalid):
+		logHTTPError(res, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, webrtc.ErrHLSNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, webrtc.ErrHLSBlockingRequestInvalid):
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, webrtc.ErrHLSTimeout):
+		logHTTPError(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.HasSuffix(file, ".m3u8") {
+		res.Header().Set("Cache-Control", "no-cache")
+	}
+	res.Header().Set("Content-Type", contentType)
+	if _, err := res.Write(body); err != nil {
+		log.Println(err)
+	}
 }
 
 func statusHandler(res http.ResponseWriter, req *http.Request) {
-	statuses := []StreamStatus{}
-	for _, s := range webrtc.GetAllStreams() {
-		statuses = append(statuses, StreamStatus{StreamKey: s})
-	}
+	statuses := append([]webrtc.StreamStatus{}, webrtc.GetAllStreams()...)
 
 	if err := json.NewEncoder(res).Encode(statuses); err != nil {
 		logHTTPError(res, err.Error(), http.StatusBadRequest)
 	}
 }
 
+func adminTokenHandler(res http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	} else if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := playbackTokenRequestJSON{ExpiresIn: defaultPlaybackTokenExpiresIn}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if r.PlaybackID == "" || r.ExpiresIn <= 0 {
+		logHTTPError(res, "playbackId and a positive expiresIn are required", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	token, err := webrtc.MintPlaybackToken(r.PlaybackID, r.ViewerID, expiresAt)
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(playbackTokenResponseJSON{Token: token, ExpiresAt: expiresAt.Unix()}); err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// adminRecordingHandler starts recording a stream key with POST and stops it with DELETE
+func adminRecordingHandler(res http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var r recordingRequestJSON
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if r.StreamKey == "" {
+		logHTTPError(res, "streamKey is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case http.MethodPost:
+		err = webrtc.StartRecording(r.StreamKey)
+	case http.MethodDelete:
+		err = webrtc.StopRecording(r.StreamKey)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, webrtc.ErrRecordingNotConfigured) {
+		logHTTPError(res, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// adminRelayHandler lists the relay targets with GET, optionally of a single
+// `streamKey`, and adds one with POST
+func adminRelayHandler(res http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(res, http.StatusOK, relay.Targets(req.URL.Query().Get("streamKey")))
+	case http.MethodPost:
+		var target relay.Target
+		if err := json.NewDecoder(req.Body).Decode(&target); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status, err := relay.AddTarget(target)
+		if err != nil {
+			logRelayError(res, err)
+			return
+		}
+
+		writeJSON(res, http.StatusCreated, status)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminRelayTargetHandler replaces a relay target with PUT and removes it with DELETE
+func adminRelayTargetHandler(res http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := path.Base(req.URL.Path)
+	switch req.Method {
+	case http.MethodPut:
+		var target relay.Target
+		if err := json.NewDecoder(req.Body).Decode(&target); err != nil {
+			logHTTPError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		status, err := relay.UpdateTarget(id, target)
+		if err != nil {
+			logRelayError(res, err)
+			return
+		}
+
+		writeJSON(res, http.StatusOK, status)
+	case http.MethodDelete:
+		if err := relay.RemoveTarget(id); err != nil {
+			logRelayError(res, err)
+			return
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// metadataHandler inserts the body into the video of /api/metadata/{stream},
+// stream is a playback ID. It is authorized by the Stream Key of the broadcast
+// or ADMIN_API_TOKEN. JSON bodies are validated, anything else is sent as is.
+func metadataHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		logHTTPError(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playbackID := path.Base(req.URL.Path)
+	if streamKey := bearerToken(req); streamKey == "" {
+		logHTTPError(res, "Authorization was not set", http.StatusUnauthorized)
+		return
+	} else if !isAdmin(req) {
+		grant, err := authorization.AuthorizePublish(authorization.NewMetadataRequest(streamKey, req.RemoteAddr, req.UserAgent()))
+		if errors.Is(err, authorization.ErrUnauthorized) || (err == nil && webrtc.PlaybackID(grant.StreamKey) != playbackID) {
+			logHTTPError(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			logHTTPError(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, metadataRequestMaxSize))
+	if err != nil {
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(data) == 0 {
+		logHTTPError(res, "Metadata is empty", http.StatusBadRequest)
+		return
+	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") && !json.Valid(data) {
+		logHTTPError(res, "Metadata is not valid JSON", http.StatusBadRequest)
+		return
+	}
+
+	err = webrtc.SendMetadata(playbackID, data)
+	switch {
+	case errors.Is(err, webrtc.ErrMetadataTooLarge):
+		logHTTPError(res, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, webrtc.ErrStreamNotLive):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, webrtc.ErrMetadataNotSupported):
+		logHTTPError(res, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func logRelayError(res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, relay.ErrTargetNotFound):
+		logHTTPError(res, err.Error(), http.StatusNotFound)
+	case errors.Is(err, relay.ErrTargetInvalid), errors.Is(err, relay.ErrProtocolNotSupported):
+		logHTTPError(res, err.Error(), http.StatusBadRequest)
+	default:
+		logHTTPError(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// isAdmin checks the bearer token against ADMIN_API_TOKEN, the admin API is
+// disabled when it isn't set
+func isAdmin(req *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_API_TOKEN")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken(req)), []byte(adminToken)) == 1
+}
+
 func indexHTMLWhenNotFound(fs http.FileSystem) http.Handler {
 	fileServer := http.FileServer(fs)
 
@@ -179,8 +611,19 @@ func main() {
 	}
 
 	webrtc.Configure()
+	authorization.Configure()
 
-	relay.InitRelay(webrtc.GetWhepClient())
+	relay.Configure()
+
+	// Relayed streams are deleted on the remote endpoints before exiting
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		relay.Shutdown()
+		os.Exit(0)
+	}()
 
 	if os.Getenv("ENABLE_HTTP_REDIRECT") != "" {
 		go func() {
@@ -197,13 +640,28 @@ func main() {
 
 	}
 
+	if rtmpAddress := os.Getenv("RTMP_ADDRESS"); rtmpAddress != "" {
+		go func() {
+			log.Println("Running RTMP Server at `" + rtmpAddress + "`")
+			log.Fatal(rtmp.ListenAndServe(rtmpAddress, rtmpPublishHandler))
+		}()
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/", indexHTMLWhenNotFound(http.Dir("./web/build")))
 	mux.HandleFunc("/api/whip", corsHandler(whipHandler))
+	mux.HandleFunc("/api/whip/", corsHandler(whipSessionHandler))
 	mux.HandleFunc("/api/whep", corsHandler(whepHandler))
+	mux.HandleFunc("/api/whep/", corsHandler(whepSessionHandler))
+	mux.HandleFunc("/api/hls/", corsHandler(hlsHandler))
 	mux.HandleFunc("/api/status", corsHandler(statusHandler))
 	mux.HandleFunc("/api/sse/", corsHandler(whepServerSentEventsHandler))
 	mux.HandleFunc("/api/layer/", corsHandler(whepLayerHandler))
+	mux.HandleFunc("/api/metadata/", corsHandler(metadataHandler))
+	mux.HandleFunc("/api/admin/token", corsHandler(adminTokenHandler))
+	mux.HandleFunc("/api/admin/recording", corsHandler(adminRecordingHandler))
+	mux.HandleFunc("/api/admin/relay", corsHandler(adminRelayHandler))
+	mux.HandleFunc("/api/admin/relay/", corsHandler(adminRelayTargetHandler))
 
 	server := &http.Server{
 		Handler: mux,
@@ -114,8 +114,8 @@ function Player({ cinemaMode }) {
       />
 
       {videoLayers.length >= 2 &&
-        <select defaultValue="disabled" onChange={onLayerChange} className="appearance-none border w-full py-2 px-3 leading-tight focus:outline-none focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded shadow-md placeholder-gray-200">
-          <option value="disabled" disabled={true}>Choose Quality Level</option>
+        <select defaultValue="auto" onChange={onLayerChange} className="appearance-none border w-full py-2 px-3 leading-tight focus:outline-none focus:shadow-outline bg-gray-700 border-gray-700 text-white rounded shadow-md placeholder-gray-200">
+          <option value="auto">Automatic Quality Level</option>
           {videoLayers.map(layer => {
             return <option key={layer} value={layer}>{layer}</option>
           })}
@@ -1,10 +1,12 @@
 import React from 'react'
-import { useLocation } from 'react-router-dom'
+import { parseLinkHeader } from '@web3-storage/parse-link-header'
+import { Link, useLocation } from 'react-router-dom'
 
 function Player(props) {
   const videoRef = React.useRef(null)
   const location = useLocation()
   const [mediaAccessError, setMediaAccessError] = React.useState(null);
+  const [playbackPath, setPlaybackPath] = React.useState(null);
 
   React.useEffect(() => {
     const peerConnection = new RTCPeerConnection() // eslint-disable-line
@@ -57,6 +59,11 @@ function Player(props) {
             'Content-Type': 'application/sdp'
           }
         }).then(r => {
+          const parsedLinkHeader = parseLinkHeader(r.headers.get('Link'))
+          if (parsedLinkHeader && parsedLinkHeader['alternate']) {
+            setPlaybackPath(parsedLinkHeader['alternate'].url)
+          }
+
           return r.text()
         }).then(answer => {
           peerConnection.setRemoteDescription({
@@ -78,6 +85,11 @@ function Player(props) {
   return (
     <div className='container mx-auto'>
       {mediaAccessError != null && <MediaAccessError>{mediaAccessError}</MediaAccessError>}
+      {playbackPath != null &&
+        <p className='bg-gray-800 text-white text-lg text-center p-5 rounded-t-lg'>
+          Viewers can watch at <Link to={playbackPath} className='underline'>{window.location.origin + playbackPath}</Link>
+        </p>
+      }
       <video
         ref={videoRef}
         autoPlay